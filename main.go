@@ -3,28 +3,88 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+	"unicode"
 
+	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/list"
+	"github.com/charmbracelet/bubbles/spinner"
 	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+	"github.com/charmbracelet/x/term"
 	"gopkg.in/yaml.v3"
 )
 
 const (
 	defaultWidth  = 80
 	defaultHeight = 24
+
+	// How many recently used destinations the state file remembers
+	maxRecentDestinations = 20
+
+	// Errors and warnings kept for the session error log
+	maxErrorLog = 50
+
+	// How long to wait for another instance to release the config, and
+	// when to consider a leftover lock file abandoned
+	configLockTimeout = 5 * time.Second
+	configLockStale   = 30 * time.Second
+
+	// Upper bound for the global post_connect command
+	postConnectTimeout = 30 * time.Second
+	probeTimeout       = 5 * time.Second
+	stopWait           = 5 * time.Second
+	latencyTimeout     = 2 * time.Second
+	latencyTTL         = 30 * time.Second
+
+	// -health connects to this port inside each tunnel unless probe_address
+	// names one, giving up after healthTimeout
+	healthPort    = "22"
+	healthTimeout = 5 * time.Second
+
+	// Connectivity checks: default per-host timeout, parallelism and the
+	// overall limit for -test-all
+	defaultConnectTimeout = 10
+	testAllWorkers        = 8
+	testAllTimeout        = 2 * time.Minute
+
+	// How long -check-updates waits for update_url
+	updateCheckTimeout = 5 * time.Second
+
+	// Supervisor polling interval and reconnect backoff bounds
+	superviseInterval   = 5 * time.Second
+	superviseMinBackoff = 1 * time.Second
+	superviseMaxBackoff = 60 * time.Second
+
+	// Below this size the list can't render legibly
+	minWidth  = 40
+	minHeight = 10
 )
 
 var (
@@ -86,8 +146,37 @@ var (
 		Foreground(primaryColor).
 		Margin(1, 0, 2, 2)
 
-	debugMode = false
-	sshMode   = false
+	warningStyle = lipgloss.NewStyle().
+		Foreground(warningColor).
+		MarginLeft(2)
+
+	// version is set at build time with -ldflags "-X main.version=v1.2.3"
+	version = "dev"
+
+	debugMode    = false
+	sshMode      = false
+	detachMode    = false
+	readOnlyMode  = false
+	newWindowMode = false
+	sudoMode      = false // -sudo, as if every tunnel set sudo
+
+	// foregroundTail runs tunnels in the foreground showing only this many
+	// of sshuttle's latest output lines, see runTailed. 0 is off.
+	foregroundTail = 0
+
+	// configFile is the config path given with -config, empty for
+	// config.yaml in configDir, see configPath
+	configFile = ""
+
+	// hostKeyChecking is the config's host_key_checking, set when the
+	// config is loaded
+	hostKeyChecking = "no"
+
+	errConfigReadOnly = fmt.Errorf("config is read-only")
+
+	// errConfigUnchanged is returned by an updateConfig fn that changed
+	// nothing, so the file is left as it is
+	errConfigUnchanged = fmt.Errorf("config unchanged")
 )
 
 type itemType int
@@ -105,12 +194,76 @@ type item struct {
 	itemType    itemType
 	pid         int // for active tunnels
 	isSSHDirect bool // true if this is direct SSH connection
+	routesAll   bool // true if subnets include 0.0.0.0/0 or ::/0
+	fullCommand string       // command line of an active tunnel as seen in ps
+	tunnel      TunnelConfig // config an available tunnel was built from
+	running     bool         // available tunnel whose destination is active
+	orphan      bool         // active tunnel that matches no configured tunnel
+	configName  string       // configured tunnel an active tunnel was started from
+	active      activeTunnel // process of an active tunnel
+	paused      bool         // available tunnel that was paused, resumed when selected
+	pausedAt    time.Time    // when a paused tunnel was paused
 }
 
 type activeTunnel struct {
 	PID         int
 	Command     string
 	Destination string
+	Args        sshuttleArgs // parsed Command, zero if it didn't parse
+	StartTime   time.Time    // zero when it couldn't be determined
+}
+
+// jsonSchemaVersion is the version field of -json output. It changes only
+// when a field is renamed or removed or changes meaning; new fields may be
+// added without a bump.
+const jsonSchemaVersion = 1
+
+// ListJSON is the output of -list -json.
+type ListJSON struct {
+	Version int          `json:"version"`
+	Tunnels []TunnelJSON `json:"tunnels"`
+}
+
+// TunnelJSON is a configured tunnel in -list -json output.
+type TunnelJSON struct {
+	Name        string   `json:"name"`
+	Host        string   `json:"host"`
+	User        string   `json:"user"`
+	Destination string   `json:"destination"` // user@host
+	Subnets     []string `json:"subnets"`     // including subnets_from
+	ExtraArgs   string   `json:"extra_args"`
+	Interactive bool     `json:"interactive"`
+	AutoConnect bool     `json:"auto_connect"`
+	Running     bool     `json:"running"`
+	PID         int      `json:"pid"` // of the running tunnel, 0 when not running
+	Group       string   `json:"group,omitempty"`
+}
+
+// StatusJSON is the output of -status -json.
+type StatusJSON struct {
+	Version int                `json:"version"`
+	Tunnels []ActiveTunnelJSON `json:"tunnels"`
+}
+
+// ActiveTunnelJSON is a running sshuttle process in -status -json output.
+type ActiveTunnelJSON struct {
+	PID           int      `json:"pid"`
+	Destination   string   `json:"destination"`
+	Subnets       []string `json:"subnets"`
+	Command       string   `json:"command"`
+	StartedAt     string   `json:"started_at"`     // RFC 3339, "" if unknown
+	UptimeSeconds int64    `json:"uptime_seconds"` // 0 if unknown
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return fmt.Errorf("failed to encode JSON: %v", err)
+	}
+	return nil
 }
 
 type TunnelConfig struct {
@@ -118,16 +271,263 @@ type TunnelConfig struct {
 	Host        string `yaml:"host"`
 	User        string `yaml:"user"`
 	Subnets     string `yaml:"subnets"`
-	ExtraArgs   string `yaml:"extra_args,omitempty"`
+	ExtraArgs   ExtraArgs `yaml:"extra_args,omitempty"`
+	ExcludeFrom string    `yaml:"exclude_from,omitempty"` // file of CIDRs passed to --exclude-from
+
+	// Exclude lists CIDRs, comma- or space-separated, never routed through
+	// the tunnel, each passed as -x
+	Exclude string `yaml:"exclude,omitempty"`
+
+	// DNS also tunnels DNS requests (--dns), to NSHosts when set, a
+	// comma-separated list of name server IPs (--ns-hosts)
+	DNS     bool   `yaml:"dns,omitempty"`
+	NSHosts string `yaml:"ns_hosts,omitempty"`
+
+	// Options holds additional sshuttle long options (e.g. latency-buffer-size)
+	// rendered as --key=value, or --key when the value is empty
+	Options map[string]string `yaml:"options,omitempty"`
+
+	// Env is added to the environment of sshuttle and the connectivity check
+	Env map[string]string `yaml:"env,omitempty"`
+
+	// ConnectTimeout is the SSH connect timeout in seconds for connectivity checks
+	ConnectTimeout int `yaml:"connect_timeout,omitempty"`
+
+	// ProxyCommand is passed to ssh as -o ProxyCommand, e.g. to reach the
+	// host through a SOCKS proxy
+	ProxyCommand string `yaml:"proxy_command,omitempty"`
+
+	// SSMInstance reaches the host through an AWS SSM session to this
+	// instance instead of a direct connection
+	SSMInstance string `yaml:"ssm_instance,omitempty"`
+
+	// Interactive tunnels need a terminal for authentication (2FA prompts),
+	// so they run in the foreground instead of with --daemon
+	Interactive bool `yaml:"interactive,omitempty"`
+
+	// Sudo runs sshuttle itself as root through sudo, for setups where
+	// sshuttle's own sudo call for its firewall rules fails
+	Sudo bool `yaml:"sudo,omitempty"`
+
+	// AutoConnect tunnels are started by -autoconnect
+	AutoConnect bool `yaml:"auto_connect,omitempty"`
+
+	// Additive tunnels start alongside the running ones; starting any
+	// other tunnel stops all running tunnels first
+	Additive bool `yaml:"additive,omitempty"`
+
+	// Listen is sshuttle's --listen address, [ip:]port
+	Listen string `yaml:"listen,omitempty"`
+
+	// ProbeAddress is an IP inside the tunneled subnets whose reverse DNS
+	// name is shown after connecting; ProbeExpect is a substring that name
+	// must contain, e.g. "corp.internal", or a mismatch is reported
+	ProbeAddress string `yaml:"probe_address,omitempty"`
+	ProbeExpect  string `yaml:"probe_expect,omitempty"`
+
+	// PostConnect is a shell command run in the foreground once this
+	// tunnel is up, after the global post_connect, e.g. a database client
+	PostConnect string `yaml:"post_connect,omitempty"`
+
+	// Method is sshuttle's firewall --method; empty lets sshuttle pick
+	Method string `yaml:"method,omitempty"`
+
+	// Family restricts the tunnel to IPv4 ("4") or IPv6 ("6"); empty
+	// routes both
+	Family string `yaml:"family,omitempty"`
+
+	// Alias is a short code such as "pd" accepted wherever -name is, and
+	// typed in the TUI to jump to the tunnel
+	Alias string `yaml:"alias,omitempty"`
+
+	// Group lists the tunnel in its own section of the TUI and selects it
+	// with -group; ungrouped tunnels are in "Other"
+	Group string `yaml:"group,omitempty"`
+
+	// Users lists several users to connect to Host as. The tunnel is shown
+	// once per user, named "Name (user)", and User is ignored.
+	Users []string `yaml:"users,omitempty"`
+
+	// HostKeyChecking overrides the top-level host_key_checking
+	HostKeyChecking string `yaml:"host_key_checking,omitempty"`
+
+	// SSHOptions are passed to ssh as -o Key=value, e.g. Compression: "yes"
+	SSHOptions map[string]string `yaml:"ssh_options,omitempty"`
+
+	// SubnetsFrom is a file of CIDRs, one per line or comma-separated,
+	// routed in addition to Subnets
+	SubnetsFrom string `yaml:"subnets_from,omitempty"`
+}
+
+// ExtraArgs is extra_args, written either as one string or as a list whose
+// entries are joined with spaces, e.g. one flag and its value per line.
+// Entries are shell words, quoted like the string form. A list is saved back
+// as a list.
+type ExtraArgs struct {
+	Line string   // string form
+	List []string // list form, nil for the string form
+}
+
+// String returns the arguments as one string of shell words.
+func (a ExtraArgs) String() string {
+	if a.List != nil {
+		return strings.Join(a.List, " ")
+	}
+	return a.Line
+}
+
+func (a ExtraArgs) IsZero() bool {
+	return a.String() == ""
+}
+
+func (a *ExtraArgs) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		a.List = []string{}
+		return node.Decode(&a.List)
+	}
+	return node.Decode(&a.Line)
+}
+
+func (a ExtraArgs) MarshalYAML() (interface{}, error) {
+	if a.List != nil {
+		return a.List, nil
+	}
+	return a.Line, nil
+}
+
+// parsedExtraArgs is extra_args split into shell words, see parseExtraArgs.
+type parsedExtraArgs struct {
+	identityFile string   // ssh key given with -i, for ssh rather than sshuttle
+	rest         []string // everything else, for sshuttle
+}
+
+// restLine returns the args for sshuttle quoted back into a command line.
+func (a parsedExtraArgs) restLine() string {
+	quoted := make([]string, len(a.rest))
+	for i, arg := range a.rest {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// parseExtraArgs splits extra_args into shell words, honoring quotes, and
+// takes out the ssh identity file given as -i path, -i=path or -ipath, so
+// key paths may contain spaces. The first key wins. Unbalanced quotes
+// leave nothing usable, while a -i without a path is dropped; both are
+// reported as an error alongside whatever could be parsed.
+func parseExtraArgs(args string) (parsedExtraArgs, error) {
+	var parsed parsedExtraArgs
+	tokens, err := splitArgs(args)
+	if err != nil {
+		return parsed, err
+	}
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		path, isKey := identityArg(token)
+		if parsed.identityFile != "" || !isKey {
+			parsed.rest = append(parsed.rest, token)
+			continue
+		}
+		switch {
+		case token != "-i":
+			parsed.identityFile = path
+		case i+1 < len(tokens):
+			parsed.identityFile = tokens[i+1]
+			i++
+		default:
+			err = fmt.Errorf("-i needs a key path")
+		}
+	}
+	return parsed, err
+}
+
+// identityArg reports whether token is an ssh -i option, as -i, -i=path
+// or -ipath, and returns the path given with it. A path glued to -i must
+// start with /, ~, . or $, so that other options starting with -i are
+// not taken for a key.
+func identityArg(token string) (string, bool) {
+	switch {
+	case token == "-i":
+		return "", true
+	case strings.HasPrefix(token, "-i="):
+		return token[3:], true
+	case strings.HasPrefix(token, "-i") && strings.ContainsAny(token[2:3], "/~.$"):
+		return token[2:], true
+	}
+	return "", false
 }
 
 type Config struct {
-	Tunnels []TunnelConfig `yaml:"tunnels"`
+	Tunnels         []TunnelConfig    `yaml:"tunnels"`
+	SubnetTemplates map[string]string `yaml:"subnet_templates,omitempty"` // host glob -> default subnets
+
+	ConfirmQuitWithActive bool `yaml:"confirm_quit_with_active,omitempty"`
+
+	// DefaultSubnets are used by -add when -subnets is omitted and no
+	// subnet template matches
+	DefaultSubnets string `yaml:"default_subnets,omitempty"`
+
+	// PostConnect is a shell command run once after any tunnel starts
+	PostConnect string `yaml:"post_connect,omitempty"`
+
+	// TerminalCmd opens a terminal window running the shell command given
+	// as its last argument, for -new-window, e.g. "alacritty -e sh -c"
+	TerminalCmd string `yaml:"terminal_cmd,omitempty"`
+
+	// UpdateURL returns the latest released version as plain text, for
+	// -check-updates
+	UpdateURL string `yaml:"update_url,omitempty"`
+
+	// HostKeyChecking is ssh's StrictHostKeyChecking for every tunnel: no
+	// (the default for configs that predate it), accept-new or yes. New
+	// configs are created with accept-new.
+	HostKeyChecking string `yaml:"host_key_checking,omitempty"`
+
+	// Keybindings maps action names to comma-separated keys, overriding
+	// defaultKeybindings per action
+	Keybindings map[string]string `yaml:"keybindings,omitempty"`
+}
+
+// State holds what the selector remembers between runs. It lives next to
+// the config but is never edited by hand.
+type State struct {
+	RecentDestinations []string `yaml:"recent_destinations,omitempty"`
+
+	// RootWarningShown is set once the user was told not to run as root
+	RootWarningShown bool `yaml:"root_warning_shown,omitempty"`
+
+	// VerboseActive shows details of active tunnels, toggled in the TUI
+	VerboseActive bool `yaml:"verbose_active,omitempty"`
+
+	// Paused lists tunnels stopped with the pause key, oldest first
+	Paused []PausedTunnel `yaml:"paused,omitempty"`
+}
+
+// PausedTunnel is a tunnel stopped with the pause key. Resuming runs
+// Command again as is.
+type PausedTunnel struct {
+	Name        string    `yaml:"name,omitempty"` // list name of the configured tunnel, "" if none
+	Destination string    `yaml:"destination"`
+	Command     string    `yaml:"command"`
+	PausedAt    time.Time `yaml:"paused_at"`
+}
+
+// FilterValue leaves section headers and separators out of search results,
+// so a search can only land on something selectable.
+func (i item) FilterValue() string {
+	if !isSelectableItem(i) {
+		return ""
+	}
+	return i.name
 }
 
-func (i item) FilterValue() string { return i.name }
+type itemDelegate struct {
+	verbose bool // show subnets, daemon mode and uptime of active tunnels
 
-type itemDelegate struct{}
+	// TCP connect time to each active tunnel's host, filled in by
+	// latencyMsg while verbose
+	latency map[string]string
+}
 
 func (d itemDelegate) Height() int                             { return 1 }
 func (d itemDelegate) Spacing() int                            { return 0 }
@@ -148,13 +548,13 @@ func (d itemDelegate) Render(w io.Writer, m list.Model, index int, listItem list
 	switch i.itemType {
 	case ItemAction:
 		if strings.Contains(i.name, "CURRENT TUNNEL") {
-			content = "CURRENT TUNNEL"
+			content = i.name
 			style = sectionStyle
 		} else if strings.Contains(i.name, "AVAILABLE TUNNELS") {
 			content = "AVAILABLE TUNNELS"
 			style = sectionStyle
-		} else if strings.Contains(i.name, "Add New") {
-			content = "+ Add New Tunnel"
+		} else if i.command == "add_new" || i.command == "raw_command" {
+			content = i.name
 			style = actionItemStyle
 		} else {
 			content = i.name
@@ -162,13 +562,31 @@ func (d itemDelegate) Render(w io.Writer, m list.Model, index int, listItem list
 		}
 
 	case ItemActiveTunnel:
-		// Show current active tunnel with stop hint
-		content = strings.Replace(i.name, "●", "●", 1) // Keep the bullet
+		// Show current active tunnel with its uptime, when known, and
+		// stop hint
+		content = i.name
+		if !i.active.StartTime.IsZero() {
+			content = activeTunnelRow(i, formatUptime(time.Since(i.active.StartTime)))
+		}
 		style = activeItemStyle
+		if d.verbose {
+			content += " " + activeTunnelDetails(i.active, d.latency[latencyHost(i.destination)])
+		}
 
 	case ItemAvailableTunnel:
-		content = fmt.Sprintf("  %s", i.name)
-		style = availableItemStyle
+		if i.paused {
+			content = fmt.Sprintf("‖ %s [paused %s ago]", i.name, formatUptime(time.Since(i.pausedAt)))
+			style = availableItemStyle
+		} else if i.running {
+			content = fmt.Sprintf("● %s", i.name)
+			style = activeItemStyle
+		} else {
+			content = fmt.Sprintf("  %s", i.name)
+			style = availableItemStyle
+		}
+		if i.tunnel.Interactive {
+			content += " [interactive]"
+		}
 
 	default:
 		content = i.name
@@ -193,555 +611,6727 @@ type model struct {
 	choice   string
 	quitting bool
 	filter   textinput.Model
-}
+	warnings []string // shown in the panel below the list
+	detail   string   // full command of the highlighted active tunnel, toggled with c
 
-func (m model) Init() tea.Cmd {
-	return nil
-}
+	chosen item // the available tunnel picked with enter
 
-func isSelectableItem(i item) bool {
-	// Section headers and empty separators are not selectable
-	if i.itemType == ItemAction && (strings.Contains(i.name, "TUNNEL") || i.name == "") {
-		return false
-	}
-	return true
-}
+	confirmQuit    bool // ask before quitting while tunnels are active
+	confirmingQuit bool
 
-func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
-	switch msg := msg.(type) {
-	case tea.WindowSizeMsg:
-		m.list.SetWidth(msg.Width)
-		return m, nil
+	deleting item // tunnel waiting for confirmation of its deletion
 
-	case tea.KeyMsg:
-		switch keypress := msg.String(); keypress {
-		case "ctrl+c", "q":
-			m.quitting = true
-			return m, tea.Quit
+	keys map[string]string // key -> action, see resolveKeybindings
 
-		case "up", "k":
-			// Navigate up, skipping non-selectable items
-			currentIndex := m.list.Index()
-			for i := currentIndex - 1; i >= 0; i-- {
-				if item, ok := m.list.Items()[i].(item); ok && isSelectableItem(item) {
-					m.list.Select(i)
-					break
-				}
-			}
-			return m, nil
+	readOnly bool // config can't be modified, see configReadOnly
 
-		case "down", "j":
-			// Navigate down, skipping non-selectable items
-			currentIndex := m.list.Index()
-			items := m.list.Items()
-			for i := currentIndex + 1; i < len(items); i++ {
-				if item, ok := items[i].(item); ok && isSelectableItem(item) {
-					m.list.Select(i)
-					break
-				}
-			}
-			return m, nil
+	terminalCmd string // terminal_cmd from the config, for -new-window
 
-		case "enter":
-			i, ok := m.list.SelectedItem().(item)
-			if ok && isSelectableItem(i) {
-				// Handle different item types
-				switch i.itemType {
-				case ItemActiveTunnel:
-					// Kill current tunnel
-					if err := killTunnel(i.pid); err != nil {
-						m.choice = fmt.Sprintf("Failed to stop tunnel: %v", err)
-					} else {
-						m.choice = fmt.Sprintf("Tunnel stopped: %s", i.destination)
-					}
-				case ItemAvailableTunnel:
-					if i.isSSHDirect {
-						// Direct SSH connection - don't kill tunnels, just connect
-						m.choice = i.command
-					} else {
-						// Kill any existing tunnel first, then start new one
-						if err := killAllTunnels(); err != nil {
-							log.Printf("Warning: Failed to kill existing tunnels: %v", err)
-						}
-						// Start the selected tunnel
-						m.choice = i.command
-					}
-				case ItemAction:
-					if i.command == "add_new" {
-						m.choice = "add_new_tunnel"
-					}
-				}
-			}
-			return m, tea.Quit
-		}
-	}
+	verboseActive bool // see itemDelegate.verbose
 
-	var cmd tea.Cmd
-	m.list, cmd = m.list.Update(msg)
-	return m, cmd
-}
+	watch bool // reload the list every watchInterval, see -watch
 
-func (m model) View() string {
-	if m.choice != "" {
-		return quitTextStyle.Render(m.choice)
-	}
-	if m.quitting {
-		return quitTextStyle.Render("Goodbye!")
-	}
+	latency   map[string]string // see itemDelegate.latency
+	latencyAt time.Time         // when latency was last measured
 
-	helpText := helpStyle.Render("↑/↓ navigate • enter select • q quit • / search")
+	aliasTyped string // start of an alias typed so far
 
-	return m.list.View() + "\n" + helpText
-}
+	// Connectivity test of the highlighted tunnel, see connTestMsg
+	testing    string // name of the tunnel being tested
+	testResult string // rendered outcome of the last test
+	spinner    spinner.Model
 
-func getActiveTunnels() ([]activeTunnel, error) {
-	cmd := exec.Command("ps", "aux")
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, err
-	}
+	// Session error log, oldest first, shown with the errors key
+	errorLog   []errorLogEntry
+	showErrors bool
+	errorView  viewport.Model
 
-	var tunnels []activeTunnel
-	scanner := bufio.NewScanner(bytes.NewReader(output))
-	re := regexp.MustCompile(`sshuttle.*-r\s+(\S+)`)
+	width  int
+	height int
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, "sshuttle") && strings.Contains(line, "-r") {
-			fields := strings.Fields(line)
-			if len(fields) > 1 {
-				pid, err := strconv.Atoi(fields[1])
-				if err != nil {
-					continue
-				}
+	// Raw command entry
+	rawStage   rawStage
+	rawInput   textinput.Model
+	rawCommand string
+	rawErr     string
 
-				matches := re.FindStringSubmatch(line)
-				destination := "unknown"
-				if len(matches) > 1 {
-					destination = matches[1]
-				}
+	overrideItem item // tunnel whose subnets are being overridden
 
-				tunnels = append(tunnels, activeTunnel{
-					PID:         pid,
-					Command:     line,
-					Destination: destination,
-				})
-			}
-		}
-	}
+	// Add tunnel form, see updateAddForm
+	adding    bool
+	addInputs []textinput.Model // one per addFormFields entry
+	addFocus  int
+	addErr    string
 
-	return tunnels, nil
+	// Config entry being edited in the add form, see openEditForm
+	editName   string // its name in the config, empty when adding
+	editTunnel TunnelConfig
+	editUser   string // user of the highlighted row, for entries with users
+
+	// Route preview of previewItem, enter connects it
+	previewing  bool
+	previewItem item
+	previewText string
 }
 
-func killTunnel(pid int) error {
-	cmd := exec.Command("kill", strconv.Itoa(pid))
-	return cmd.Run()
+type errorLogEntry struct {
+	time    time.Time
+	message string
 }
 
-func killAllTunnels() error {
-	tunnels, err := getActiveTunnels()
-	if err != nil {
-		return err
+// logError records message in the session error log, dropping the oldest
+// entries beyond maxErrorLog.
+func (m *model) logError(message string) {
+	m.errorLog = append(m.errorLog, errorLogEntry{time: time.Now(), message: message})
+	if len(m.errorLog) > maxErrorLog {
+		m.errorLog = m.errorLog[len(m.errorLog)-maxErrorLog:]
 	}
+}
 
-	for _, tunnel := range tunnels {
-		if err := killTunnel(tunnel.PID); err != nil {
-			log.Printf("Failed to kill tunnel %d: %v", tunnel.PID, err)
-		}
+// errorLogView renders the error log for the overlay, newest first.
+func (m model) errorLogView() string {
+	if len(m.errorLog) == 0 {
+		return statusStyle.Render("No errors this session")
+	}
+	var lines []string
+	for i := len(m.errorLog) - 1; i >= 0; i-- {
+		entry := m.errorLog[i]
+		lines = append(lines, statusStyle.Render(entry.time.Format("15:04:05"))+" "+entry.message)
 	}
+	return strings.Join(lines, "\n")
+}
 
-	return nil
+// interactiveDoneMsg reports that a foreground interactive tunnel ended.
+type interactiveDoneMsg struct {
+	destination string
+	err         error
+	hint        string // see sshuttleErrorHint
 }
 
-func loadAllItems() ([]list.Item, error) {
-	var items []list.Item
+// tunnelStoppedMsg reports whether a tunnel stopped from the list has
+// exited, see waitForStop.
+type tunnelStoppedMsg struct {
+	destination string
+	pid         int
+	exited      bool
+	paused      bool // stopped with the pause key
+}
 
-	// Get active tunnels (should be only one now)
-	activeTunnels, err := getActiveTunnels()
-	if err != nil {
-		log.Printf("Error getting active tunnels: %v", err)
-	}
+// connTestMsg reports the connectivity test of a tunnel started with the
+// test key.
+type connTestMsg struct {
+	name string
+	err  error
+}
 
-	// Add current active tunnel (if any)
-	if len(activeTunnels) > 0 {
-		// Take only the first active tunnel (single tunnel mode)
-		tunnel := activeTunnels[0]
-		items = append(items, item{
-			name:     "CURRENT TUNNEL",
-			itemType: ItemAction,
-			command:  "",
-		})
+// latencyMsg carries fresh measureLatency results.
+type latencyMsg map[string]string
 
-		items = append(items, item{
-			name:        fmt.Sprintf("● %s (PID: %d) - Click to stop", tunnel.Destination, tunnel.PID),
-			destination: tunnel.Destination,
-			command:     fmt.Sprintf("kill %d", tunnel.PID),
-			itemType:    ItemActiveTunnel,
-			pid:         tunnel.PID,
-		})
+type rawStage int
 
-		// Add separator
-		items = append(items, item{
-			name:     "",
-			itemType: ItemAction,
-			command:  "",
-		})
-	}
+const (
+	rawStageNone rawStage = iota
+	rawStageCommand
+	rawStageName
+	rawStageSubnets // subnets for this connection of overrideItem
+	rawStageImport  // name to save the orphaned tunnel rawCommand under
+)
 
-	// Add available tunnels section
-	items = append(items, item{
-		name:     "AVAILABLE TUNNELS",
-		itemType: ItemAction,
-		command:  "",
-	})
+// Fields of the add tunnel form, indexes into model.addInputs
+const (
+	addFieldName = iota
+	addFieldHost
+	addFieldUser
+	addFieldSubnets
+	addFieldExtraArgs
+)
 
-	// Load config tunnels
-	configItems, err := loadConfigTunnels()
-	if err != nil {
-		return nil, err
+// addFormFields are the labels of the add tunnel form fields, in order.
+var addFormFields = []string{"Name", "Host", "User", "Subnets", "Extra args"}
+
+func (m model) Init() tea.Cmd {
+	if m.watch {
+		return tea.Batch(m.latencyCmd(false), watchTick())
 	}
+	return m.latencyCmd(false)
+}
 
-	items = append(items, configItems...)
+// watchInterval is how often -watch reloads the list.
+const watchInterval = 5 * time.Second
 
-	// Add separator and new tunnel option
-	items = append(items, item{
-		name:     "",
-		itemType: ItemAction,
-		command:  "",
-	})
-	items = append(items, item{
-		name:     "+ Add New Tunnel",
-		itemType: ItemAction,
-		command:  "add_new",
-	})
+// refreshMsg asks for the list to be reloaded, sent by watchTick.
+type refreshMsg struct{}
 
-	return items, nil
+// watchTick schedules the next reload of the list under -watch.
+func watchTick() tea.Cmd {
+	return tea.Tick(watchInterval, func(time.Time) tea.Msg {
+		return refreshMsg{}
+	})
 }
 
-func loadConfigTunnels() ([]list.Item, error) {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return nil, err
+// latencyCmd measures the latency of the listed active tunnels while
+// details are shown. Results younger than latencyTTL are reused unless
+// force is set, e.g. after the list was reloaded.
+func (m model) latencyCmd(force bool) tea.Cmd {
+	if !m.verboseActive || (!force && time.Since(m.latencyAt) < latencyTTL) {
+		return nil
 	}
-
-	configPath := filepath.Join(homeDir, ".config", "sshuttle-selector", "config.yaml")
-
-	// Check if config file exists
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		// Return default config if file doesn't exist
-		var exampleCommand string
-		if sshMode {
-			exampleCommand = "ssh -o StrictHostKeyChecking=no user@example.com"
-		} else {
-			exampleCommand = "sshuttle -r user@example.com 10.0.0.0/8"
+	var addresses []string
+	for _, listItem := range m.list.Items() {
+		if i, ok := listItem.(item); ok && i.itemType == ItemActiveTunnel {
+			addresses = append(addresses, latencyHost(i.destination))
 		}
-
-		return []list.Item{
-			item{
-				name:        "Example Server (example.com)",
-				destination: "user@example.com",
-				command:     exampleCommand,
-				itemType:    ItemAvailableTunnel,
-				isSSHDirect: sshMode,
-			},
-		}, nil
 	}
-
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		return nil, err
+	if len(addresses) == 0 {
+		return nil
 	}
-
-	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, err
+	return func() tea.Msg {
+		return latencyMsg(measureLatency(addresses))
 	}
+}
 
-	items := make([]list.Item, len(config.Tunnels))
-	for i, tunnel := range config.Tunnels {
-		// Build SSH command with key if specified
-		sshCmd := fmt.Sprintf("ssh -o StrictHostKeyChecking=no")
-		if strings.Contains(tunnel.ExtraArgs, "-i ") {
-			// Extract key path from extra_args
-			keyPath := strings.TrimSpace(strings.Split(tunnel.ExtraArgs, "-i ")[1])
-			sshCmd += fmt.Sprintf(" -i %s", keyPath)
-		}
+// defaultKeybindings lists the keys for each action that can be rebound in
+// the keybindings config section. Actions without keys are unbound.
+var defaultKeybindings = map[string][]string{
+	"up":       {"up", "k"},
+	"down":     {"down", "j"},
+	"select":   {"enter"},
+	"command":  {"c"},
+	"subnets":  {"s"},
+	"import":   {"I"},
+	"errors":   {"e"},
+	"details":  {"i"},
+	"preview":  {"p"},
+	"pause":    {"z"},
+	"test":     {"t"},
+	"quit":     {"q"},
+	"add":      {"a"},
+	"edit":     {"E"},
+	"delete":   {"d"},
+	"refresh":  {"r"},
+	"kill-all": nil,
+}
 
-		// Add debug flags if in debug mode
-		if debugMode {
-			sshCmd += " -vvv"
+// resolveKeybindings merges custom bindings over the defaults and returns a
+// key -> action map. Unknown actions and keys bound to two actions are errors.
+func resolveKeybindings(custom map[string]string) (map[string]string, error) {
+	bindings := make(map[string][]string, len(defaultKeybindings))
+	for action, keys := range defaultKeybindings {
+		bindings[action] = keys
+	}
+	for action, value := range custom {
+		if _, ok := defaultKeybindings[action]; !ok {
+			return nil, fmt.Errorf("unknown keybinding action '%s'", action)
+		}
+		var keys []string
+		for _, key := range strings.Split(value, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, key)
+			}
 		}
+		bindings[action] = keys
+	}
 
-		var command string
-		var itemName string
+	actions := make([]string, 0, len(bindings))
+	for action := range bindings {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
 
-		if sshMode {
-			// SSH direct connection mode
-			command = fmt.Sprintf("%s %s@%s", sshCmd, tunnel.User, tunnel.Host)
-			itemName = fmt.Sprintf("%s (%s)", tunnel.Name, tunnel.Host)
-		} else {
-			// Sshuttle tunnel mode
-			if debugMode {
-				// In debug mode, don't use --daemon and add -v flag
-				command = fmt.Sprintf("sshuttle -v -r %s@%s %s --ssh-cmd=\"%s\"", tunnel.User, tunnel.Host, tunnel.Subnets, sshCmd)
-			} else {
-				// Normal mode uses --daemon
-				command = fmt.Sprintf("sshuttle -r %s@%s %s --daemon --ssh-cmd=\"%s\"", tunnel.User, tunnel.Host, tunnel.Subnets, sshCmd)
+	keys := make(map[string]string)
+	for _, action := range actions {
+		for _, key := range bindings[action] {
+			if key == "ctrl+c" {
+				return nil, fmt.Errorf("key '%s' is reserved", key)
 			}
-
-			// Add other extra args (excluding -i)
-			if tunnel.ExtraArgs != "" && !strings.Contains(tunnel.ExtraArgs, "-i ") {
-				command += " " + tunnel.ExtraArgs
+			if other, ok := keys[key]; ok {
+				return nil, fmt.Errorf("key '%s' is bound to both %s and %s", key, other, action)
 			}
-
-			itemName = fmt.Sprintf("%s (%s)", tunnel.Name, tunnel.Host)
+			keys[key] = action
 		}
+	}
+	return keys, nil
+}
 
-		items[i] = item{
-			name:        itemName,
-			destination: fmt.Sprintf("%s@%s", tunnel.User, tunnel.Host),
-			command:     command,
-			itemType:    ItemAvailableTunnel,
-			isSSHDirect: sshMode,
+// keyHelp returns the first key bound to action for the help line, or ""
+// when the action is unbound.
+func (m model) keyHelp(action string) string {
+	var keys []string
+	for key, bound := range m.keys {
+		if bound == action {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	// Prefer the default key so the help line stays stable
+	for _, key := range defaultKeybindings[action] {
+		if m.keys[key] == action {
+			return displayKey(key)
 		}
 	}
+	sort.Strings(keys)
+	return displayKey(keys[0])
+}
 
-	return items, nil
+func displayKey(key string) string {
+	switch key {
+	case "up":
+		return "↑"
+	case "down":
+		return "↓"
+	}
+	return key
 }
 
-func handleAddCommand(name, host, user, subnets, extraArgs string) error {
+func isSelectableItem(i item) bool {
+	// Section headers and empty separators are not selectable
+	if i.itemType == ItemAction && (strings.Contains(i.name, "TUNNEL") || i.name == "") {
+		return false
+	}
+	return true
+}
+
+// selectNext moves the cursor to the next selectable item in the given
+// direction (1 or -1), wrapping around at either end of the list.
+func (m *model) selectNext(step int) {
+	items := m.list.VisibleItems()
+	n := len(items)
+	if n == 0 {
+		return
+	}
+	currentIndex := m.list.Index()
+	for offset := 1; offset < n; offset++ {
+		i := ((currentIndex+step*offset)%n + n) % n
+		if item, ok := items[i].(item); ok && isSelectableItem(item) {
+			m.list.Select(i)
+			return
+		}
+	}
+}
+
+func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+		m.height = msg.Height
+		m.list.SetWidth(msg.Width)
+		return m, nil
+
+	case tunnelStoppedMsg:
+		m.reloadItems()
+		if msg.exited && msg.paused {
+			m.detail = fmt.Sprintf("Paused %s, select it to resume", msg.destination)
+		} else if msg.exited {
+			m.detail = fmt.Sprintf("Stopped %s (PID %d)", msg.destination, msg.pid)
+		} else {
+			m.detail = fmt.Sprintf("%s (PID %d) is still running", msg.destination, msg.pid)
+			m.logError(m.detail)
+		}
+		return m, m.latencyCmd(true)
+
+	case connTestMsg:
+		m.testing = ""
+		if msg.err != nil {
+			m.testResult = dangerItemStyle.UnsetMarginLeft().Render(fmt.Sprintf("✗ %s unreachable (%v)", msg.name, msg.err))
+			m.logError(fmt.Sprintf("%s unreachable: %v", msg.name, msg.err))
+		} else {
+			m.testResult = activeItemStyle.UnsetMarginLeft().Render(fmt.Sprintf("✓ %s reachable", msg.name))
+		}
+		return m, nil
+
+	case spinner.TickMsg:
+		if m.testing == "" {
+			return m, nil
+		}
+		var cmd tea.Cmd
+		m.spinner, cmd = m.spinner.Update(msg)
+		return m, cmd
+
+	case refreshMsg:
+		m.reloadItems()
+		return m, tea.Batch(m.latencyCmd(false), watchTick())
+
+	case latencyMsg:
+		for address, result := range msg {
+			m.latency[address] = result
+		}
+		m.latencyAt = time.Now()
+		return m, nil
+
+	case interactiveDoneMsg:
+		if msg.err != nil {
+			m.detail = fmt.Sprintf("Tunnel to %s exited: %v", msg.destination, msg.err)
+			if msg.hint != "" {
+				m.detail += ". " + msg.hint
+			}
+			m.logError(m.detail)
+		} else {
+			m.detail = fmt.Sprintf("Tunnel to %s closed", msg.destination)
+		}
+		return m, nil
+
+	case tea.KeyMsg:
+		if m.rawStage != rawStageNone {
+			return m.updateRawCommand(msg)
+		}
+		if m.adding {
+			return m.updateAddForm(msg)
+		}
+
+		if m.showErrors {
+			switch msg.String() {
+			case "ctrl+c":
+				m.quitting = true
+				return m, tea.Quit
+			case "esc", "q", "enter":
+				m.showErrors = false
+				return m, nil
+			}
+			if m.keys[msg.String()] == "errors" {
+				m.showErrors = false
+				return m, nil
+			}
+			var cmd tea.Cmd
+			m.errorView, cmd = m.errorView.Update(msg)
+			return m, cmd
+		}
+
+		if m.previewing {
+			switch msg.String() {
+			case "ctrl+c":
+				m.quitting = true
+				return m, tea.Quit
+			case "enter", "y", "Y":
+				m.previewing = false
+				return m.startTunnel(m.previewItem)
+			default:
+				m.previewing = false
+				return m, nil
+			}
+		}
+
+		if m.deleting.name != "" {
+			i := m.deleting
+			m.deleting = item{}
+			switch msg.String() {
+			case "ctrl+c":
+				m.quitting = true
+				return m, tea.Quit
+			case "y", "Y":
+				return m.deleteTunnel(i)
+			default:
+				// Esc, n or anything else keeps the tunnel
+				return m, nil
+			}
+		}
+
+		if m.confirmingQuit {
+			switch msg.String() {
+			case "y", "Y":
+				m.quitting = true
+				return m, tea.Quit
+			default:
+				// Esc, n or anything else cancels
+				m.confirmingQuit = false
+				return m, nil
+			}
+		}
+
+		if msg.String() == "ctrl+c" {
+			m.quitting = true
+			return m, tea.Quit
+		}
+
+		if m.list.FilterState() == list.Filtering {
+			// Keys are search text while the filter is being typed
+			var cmd tea.Cmd
+			m.list, cmd = m.list.Update(msg)
+			m.ensureSelectable()
+			return m, cmd
+		}
+
+		if m.typeAlias(msg.String()) {
+			return m, nil
+		}
+
+		if msg.Type == tea.KeyRunes && !msg.Alt && len(msg.Runes) == 1 && unicode.IsPrint(msg.Runes[0]) &&
+			m.keys[msg.String()] == "" && m.list.FilteringEnabled() && !key.Matches(msg, m.list.KeyMap.Filter) {
+			// Type-to-filter: open the filter as if / was pressed, then
+			// pass it the key
+			var openCmd, typeCmd tea.Cmd
+			m.list, openCmd = m.list.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(m.list.KeyMap.Filter.Keys()[0])})
+			m.list, typeCmd = m.list.Update(msg)
+			m.ensureSelectable()
+			return m, tea.Batch(openCmd, typeCmd)
+		}
+
+		switch m.keys[msg.String()] {
+		case "quit":
+			if m.confirmQuit {
+				if tunnels, err := getActiveTunnels(); err == nil && len(tunnels) > 0 {
+					m.confirmingQuit = true
+					return m, nil
+				}
+			}
+			m.quitting = true
+			return m, tea.Quit
+
+		case "command":
+			// Toggle the full command line of the highlighted active tunnel
+			if i, ok := m.list.SelectedItem().(item); ok && i.itemType == ItemActiveTunnel && m.detail == "" {
+				m.detail = i.fullCommand
+			} else {
+				m.detail = ""
+			}
+			return m, nil
+
+		case "up":
+			m.detail = ""
+			m.testResult = ""
+			// Navigate up, skipping non-selectable items and wrapping to the bottom
+			m.selectNext(-1)
+			return m, nil
+
+		case "down":
+			m.detail = ""
+			m.testResult = ""
+			// Navigate down, skipping non-selectable items and wrapping to the top
+			m.selectNext(1)
+			return m, nil
+
+		case "subnets":
+			// Connect the highlighted tunnel with different subnets, once
+			i, ok := m.list.SelectedItem().(item)
+			if !ok || i.itemType != ItemAvailableTunnel || i.isSSHDirect {
+				return m, nil
+			}
+			m.overrideItem = i
+			m.rawStage = rawStageSubnets
+			m.rawErr = ""
+			m.rawInput = textinput.New()
+			m.rawInput.Width = 60
+			m.rawInput.SetValue(i.tunnel.Subnets)
+			m.rawInput.Focus()
+			return m, textinput.Blink
+
+		case "preview":
+			// Show what the highlighted tunnel routes before connecting it
+			i, ok := m.list.SelectedItem().(item)
+			if !ok || i.itemType != ItemAvailableTunnel || i.isSSHDirect {
+				return m, nil
+			}
+			m.previewItem = i
+			m.previewText = routePreview(i.tunnel)
+			m.previewing = true
+			return m, nil
+
+		case "pause":
+			// Stop the highlighted active tunnel, remembering its command
+			// so it can be resumed, or resume a paused one
+			i, ok := m.list.SelectedItem().(item)
+			if ok && i.paused {
+				return m.startTunnel(i)
+			}
+			if !ok || i.itemType != ItemActiveTunnel {
+				return m, nil
+			}
+			paused := m.pausedTunnel(i)
+			if err := stopActiveTunnel(i.pid, i.destination); err != nil {
+				m.detail = fmt.Sprintf("Failed to pause tunnel: %v", err)
+				m.logError(m.detail)
+				return m, nil
+			}
+			err := forgetPaused(i.destination)
+			var state *State
+			if err == nil {
+				state, err = loadState()
+			}
+			if err == nil {
+				state.Paused = append(state.Paused, paused)
+				err = saveState(state)
+			}
+			if err != nil {
+				m.logError(fmt.Sprintf("Failed to save paused tunnel, resume it with: %s (%v)", paused.Command, err))
+			}
+			m.detail = fmt.Sprintf("Pausing %s (PID %d)...", i.destination, i.pid)
+			return m, waitForStop(i.pid, i.destination, true)
+
+		case "test":
+			// Check ssh connectivity of the highlighted tunnel in the
+			// background, without starting it
+			i, ok := m.list.SelectedItem().(item)
+			if !ok || i.itemType != ItemAvailableTunnel || i.tunnel.Host == "" || m.testing != "" {
+				return m, nil
+			}
+			m.testing = i.tunnel.Name
+			m.testResult = ""
+			m.spinner = spinner.New(spinner.WithSpinner(spinner.Dot))
+			tunnel := i.tunnel
+			return m, tea.Batch(m.spinner.Tick, func() tea.Msg {
+				return connTestMsg{name: tunnel.Name, err: validateSSHConnection(tunnel)}
+			})
+
+		case "details":
+			// Toggle verbose active tunnels, remembered across runs
+			m.verboseActive = !m.verboseActive
+			m.list.SetDelegate(itemDelegate{verbose: m.verboseActive, latency: m.latency})
+			state, err := loadState()
+			if err == nil {
+				state.VerboseActive = m.verboseActive
+				err = saveState(state)
+			}
+			if err != nil {
+				m.logError(fmt.Sprintf("Failed to save state: %v", err))
+			}
+			return m, m.latencyCmd(false)
+
+		case "errors":
+			width, height := m.width-4, m.height-6
+			if m.width == 0 {
+				width, height = defaultWidth, defaultHeight
+			}
+			m.errorView = viewport.New(width, height)
+			m.errorView.SetContent(m.errorLogView())
+			m.showErrors = true
+			return m, nil
+
+		case "import":
+			// Save an orphaned tunnel's command line as a configured tunnel
+			i, ok := m.list.SelectedItem().(item)
+			if !ok || !i.orphan {
+				return m, nil
+			}
+			if m.readOnly {
+				m.detail = "Config is read-only"
+				return m, nil
+			}
+			m.rawCommand = i.fullCommand
+			m.rawStage = rawStageImport
+			m.rawErr = ""
+			m.rawInput = textinput.New()
+			m.rawInput.Placeholder = "name"
+			m.rawInput.Width = 60
+			m.rawInput.Focus()
+			return m, textinput.Blink
+
+		case "add":
+			if m.readOnly {
+				m.detail = "Config is read-only"
+				return m, nil
+			}
+			return m, m.openAddForm()
+
+		case "edit":
+			// Change the highlighted configured tunnel
+			i, ok := m.list.SelectedItem().(item)
+			if !ok || i.itemType != ItemAvailableTunnel || i.paused {
+				return m, nil
+			}
+			if m.readOnly {
+				m.detail = "Config is read-only"
+				return m, nil
+			}
+			return m, m.openEditForm(i)
+
+		case "delete":
+			// Remove the highlighted configured tunnel, once confirmed
+			i, ok := m.list.SelectedItem().(item)
+			if !ok || i.itemType != ItemAvailableTunnel || i.paused {
+				return m, nil
+			}
+			if m.readOnly {
+				m.detail = "Config is read-only"
+				return m, nil
+			}
+			m.deleting = i
+			m.detail = ""
+			return m, nil
+
+		case "refresh":
+			// Reload running and configured tunnels, e.g. after one was
+			// started elsewhere or died
+			m.reloadItems()
+			m.detail = "List refreshed"
+			return m, m.latencyCmd(true)
+
+		case "kill-all":
+			if err := killAllTunnels(); err != nil {
+				m.choice = fmt.Sprintf("Failed to kill tunnels: %v", err)
+			} else {
+				m.choice = "All tunnels killed"
+			}
+			return m, tea.Quit
+
+		case "select":
+			i, ok := m.list.SelectedItem().(item)
+			if !ok || !isSelectableItem(i) {
+				// Nothing to act on, e.g. a search without matches
+				return m, nil
+			}
+			// Handle different item types
+			switch i.itemType {
+			case ItemActiveTunnel:
+				// Stop the tunnel and stay in the list, configured or not
+				if err := stopActiveTunnel(i.pid, i.destination); err != nil {
+					m.detail = fmt.Sprintf("Failed to stop tunnel: %v", err)
+					m.logError(m.detail)
+					return m, nil
+				}
+				m.detail = fmt.Sprintf("Stopping %s (PID %d)...", i.destination, i.pid)
+				return m, waitForStop(i.pid, i.destination, false)
+			case ItemAvailableTunnel:
+				// Paused tunnels are resumed the same way
+				return m.startTunnel(i)
+			case ItemAction:
+				if i.command == "add_new" {
+					if m.readOnly {
+						m.detail = "Config is read-only"
+						return m, nil
+					}
+					return m, m.openAddForm()
+				}
+				if i.command == "raw_command" {
+					m.rawStage = rawStageCommand
+					m.rawInput = textinput.New()
+					m.rawInput.Placeholder = "sshuttle -r user@host 10.0.0.0/8"
+					m.rawInput.Width = 60
+					if state, err := loadState(); err == nil {
+						var suggestions []string
+						for _, destination := range state.RecentDestinations {
+							suggestions = append(suggestions, fmt.Sprintf("sshuttle -r %s ", destination))
+						}
+						m.rawInput.SetSuggestions(suggestions)
+						m.rawInput.ShowSuggestions = true
+					}
+					m.rawInput.Focus()
+					return m, textinput.Blink
+				}
+			}
+			return m, tea.Quit
+		}
+	}
+
+	var cmd tea.Cmd
+	if m.rawStage != rawStageNone {
+		m.rawInput, cmd = m.rawInput.Update(msg)
+		return m, cmd
+	}
+	if m.adding {
+		m.addInputs[m.addFocus], cmd = m.addInputs[m.addFocus].Update(msg)
+		return m, cmd
+	}
+	m.list, cmd = m.list.Update(msg)
+	m.ensureSelectable()
+	return m, cmd
+}
+
+// ensureSelectable moves the cursor off a section header, e.g. after the
+// filter was cleared, or back into the list when the filter left it past
+// the last match.
+func (m *model) ensureSelectable() {
+	selected := m.list.SelectedItem()
+	if selected == nil {
+		m.selectNearest(m.list.Index())
+	} else if i, ok := selected.(item); ok && !isSelectableItem(i) {
+		m.selectNext(1)
+	}
+}
+
+// typeAlias feeds key into the alias being typed and jumps to the tunnel
+// once an alias is complete. It reports whether the key was used; keys
+// bound to actions only count after the first letter of an alias.
+func (m *model) typeAlias(key string) bool {
+	if len([]rune(key)) != 1 || (m.aliasTyped == "" && m.keys[key] != "") {
+		m.aliasTyped = ""
+		return false
+	}
+
+	typed := m.aliasTyped + key
+	m.aliasTyped = ""
+	partial := false
+	for idx, listItem := range m.list.VisibleItems() {
+		i, ok := listItem.(item)
+		if !ok || i.itemType != ItemAvailableTunnel || i.tunnel.Alias == "" {
+			continue
+		}
+		if i.tunnel.Alias == typed {
+			m.list.Select(idx)
+			m.detail = ""
+			return true
+		}
+		if strings.HasPrefix(i.tunnel.Alias, typed) {
+			partial = true
+		}
+	}
+	if partial {
+		m.aliasTyped = typed
+	}
+	return partial
+}
+
+// reloadItems rebuilds the list after the config or the running tunnels
+// changed, keeping the cursor on a selectable item. Config warnings were
+// already shown on the first load and are not repeated.
+func (m *model) reloadItems() {
+	config, err := loadListConfig()
+	if err != nil {
+		// The list is kept as it was. -watch retries every few seconds, so
+		// the same failure is reported once.
+		warning := fmt.Sprintf("Failed to reload: %v", err)
+		if len(m.warnings) == 0 || m.warnings[len(m.warnings)-1] != warning {
+			m.warnings = append(m.warnings, warning)
+			m.logError(warning)
+		}
+		return
+	}
+	items, _ := loadAllItems(config)
+	index := m.list.Index()
+	m.list.SetItems(items)
+	m.selectNearest(index)
+}
+
+// selectNearest selects the selectable item closest to index, the one
+// below on a tie, e.g. to keep the cursor in place across a reload.
+func (m *model) selectNearest(index int) {
+	items := m.list.VisibleItems()
+	if index >= len(items) {
+		index = len(items) - 1
+	}
+	for offset := 0; offset < len(items); offset++ {
+		for _, i := range []int{index + offset, index - offset} {
+			if i < 0 || i >= len(items) {
+				continue
+			}
+			if item, ok := items[i].(item); ok && isSelectableItem(item) {
+				m.list.Select(i)
+				return
+			}
+		}
+	}
+}
+
+// startTunnel starts the available tunnel i: the TUI quits and main runs
+// its command, except for interactive tunnels, which run in the foreground
+// while the TUI is suspended.
+func (m model) startTunnel(i item) (tea.Model, tea.Cmd) {
+	if i.isSSHDirect {
+		// Direct SSH connection - don't kill tunnels, just connect
+		m.choice = i.command
+		return m, tea.Quit
+	}
+	if isDestinationActive(i.destination) {
+		// Don't restart a tunnel that is already up
+		m.choice = fmt.Sprintf("Already connected: %s", i.destination)
+		return m, tea.Quit
+	}
+
+	// Kill any existing tunnel first, then start new one, unless this one
+	// runs alongside them
+	if !i.tunnel.Additive {
+		if err := killAllTunnels(); err != nil {
+			m.logError(fmt.Sprintf("Failed to kill existing tunnels: %v", err))
+		}
+	}
+	if err := checkListenAvailable(i.tunnel.Listen); err != nil {
+		m.choice = fmt.Sprintf("Can't start %s: %v", i.tunnel.Name, err)
+		return m, tea.Quit
+	}
+	// Starting a paused tunnel, or one like it, resumes it
+	if err := forgetPaused(i.destination); err != nil {
+		m.logError(fmt.Sprintf("Failed to save state: %v", err))
+	}
+	if newWindowMode {
+		err := startInNewWindow(m.terminalCmd, i.command, i.tunnel.Env)
+		if err == nil {
+			recordDestinations(i.destination)
+			logActivity("start", i.tunnel.Name, i.destination, 0, "new window")
+			m.detail = fmt.Sprintf("Started %s in a new terminal window", i.tunnel.Name)
+			return m, nil
+		}
+		m.logError(fmt.Sprintf("%v, running in this terminal", err))
+	}
+	if i.tunnel.Interactive {
+		// Hand the terminal to sshuttle so authentication
+		// prompts reach the user, then come back to the list
+		recordDestinations(i.destination)
+		cmd := exec.Command("sh", "-c", i.command)
+		cmd.Env = tunnelEnv(i.tunnel.Env)
+		var stderr tailBuffer
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+		name, destination := i.tunnel.Name, i.destination
+		logActivity("start", name, destination, 0, "foreground")
+		return m, tea.ExecProcess(cmd, func(err error) tea.Msg {
+			logActivity("exit", name, destination, 0, exitStatus(err))
+			return interactiveDoneMsg{destination: destination, err: err, hint: sshuttleErrorHint(stderr.String())}
+		})
+	}
+	// Start the selected tunnel
+	m.choice = i.command
+	m.chosen = i
+	return m, tea.Quit
+}
+
+// pausedTunnel records what resuming the active tunnel i runs: the command
+// of the configured tunnel it was started from if that routes the same
+// subnets, as ps loses quoting, otherwise the command line ps shows.
+func (m model) pausedTunnel(i item) PausedTunnel {
+	paused := PausedTunnel{
+		Destination: i.destination,
+		Command:     sshuttleCommandLine(i.fullCommand),
+		PausedAt:    time.Now(),
+	}
+	for _, listItem := range m.list.Items() {
+		configured, ok := listItem.(item)
+		if !ok || configured.itemType != ItemAvailableTunnel || configured.paused || configured.destination != i.destination {
+			continue
+		}
+		if i.configName != "" && configured.name != i.configName {
+			continue
+		}
+		paused.Name = configured.name
+		if args, err := parseSshuttleArgs(configured.command); err == nil &&
+			strings.Join(args.Subnets, ",") == strings.Join(i.active.Args.Subnets, ",") {
+			paused.Command = configured.command
+		}
+		break
+	}
+	return paused
+}
+
+// forgetPaused drops the paused tunnels to destination from the state.
+func forgetPaused(destination string) error {
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	var kept []PausedTunnel
+	for _, paused := range state.Paused {
+		if paused.Destination != destination {
+			kept = append(kept, paused)
+		}
+	}
+	if len(kept) == len(state.Paused) {
+		return nil
+	}
+	state.Paused = kept
+	return saveState(state)
+}
+
+// withSubnets returns a copy of the available tunnel i routing subnets
+// instead of its configured ones.
+func withSubnets(i item, subnets string) (item, []string) {
+	subnets = normalizeSubnets(subnets)
+	i.tunnel.Subnets = subnets
+	i.routesAll = routesAllTraffic(subnets)
+	var warnings []string
+	i.command, warnings = buildSshuttleCommand(i.tunnel)
+	return i, warnings
+}
+
+// updateRawCommand handles keys while a raw sshuttle command is being
+// entered: first the command itself, then an optional name to save it under.
+func (m model) updateRawCommand(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "ctrl+c", "esc":
+		m.rawStage = rawStageNone
+		m.rawErr = ""
+		return m, nil
+
+	case "enter":
+		value := strings.TrimSpace(m.rawInput.Value())
+
+		if m.rawStage == rawStageImport {
+			if value == "" {
+				m.rawErr = "A name is required"
+				return m, nil
+			}
+			tunnel, err := parseSshuttleCommand(m.rawCommand)
+			if err == nil {
+				tunnel.Name = value
+				err = addTunnelToConfig(tunnel)
+			}
+			if err != nil {
+				m.rawErr = fmt.Sprintf("Can't import: %v", err)
+				m.logError(m.rawErr)
+				return m, nil
+			}
+			m.rawStage = rawStageNone
+			m.reloadItems()
+			m.detail = fmt.Sprintf("Imported as %s", value)
+			return m, nil
+		}
+
+		if m.rawStage == rawStageSubnets {
+			if err := validateSubnets(value); err != nil {
+				m.rawErr = err.Error()
+				return m, nil
+			}
+			i, warnings := withSubnets(m.overrideItem, value)
+			m.warnings = append(m.warnings, warnings...)
+			m.rawStage = rawStageNone
+			return m.startTunnel(i)
+		}
+
+		if m.rawStage == rawStageCommand {
+			if !isSshuttleCommand(value) {
+				m.rawErr = "Command must start with sshuttle"
+				return m, nil
+			}
+			m.rawCommand = value
+			if m.readOnly {
+				// Nowhere to save it, so just run it
+				m.choice = m.rawCommand
+				return m, tea.Quit
+			}
+			m.rawStage = rawStageName
+			m.rawErr = ""
+			m.rawInput.SetValue("")
+			m.rawInput.ShowSuggestions = false
+			m.rawInput.Placeholder = "name (leave empty to just run)"
+			return m, nil
+		}
+
+		if value != "" {
+			tunnel, err := parseSshuttleCommand(m.rawCommand)
+			if err == nil {
+				tunnel.Name = value
+				err = addTunnelToConfig(tunnel)
+			}
+			if err != nil {
+				m.rawErr = fmt.Sprintf("Can't save: %v", err)
+				m.logError(m.rawErr)
+				return m, nil
+			}
+		}
+
+		m.choice = m.rawCommand
+		return m, tea.Quit
+	}
+
+	var cmd tea.Cmd
+	m.rawInput, cmd = m.rawInput.Update(msg)
+	return m, cmd
+}
+
+// openAddForm shows an empty add tunnel form with the name focused.
+func (m *model) openAddForm() tea.Cmd {
+	m.adding = true
+	m.addErr = ""
+	m.detail = ""
+	m.editName = ""
+	m.addFocus = addFieldName
+	m.addInputs = make([]textinput.Model, len(addFormFields))
+	for idx := range m.addInputs {
+		m.addInputs[idx] = textinput.New()
+		m.addInputs[idx].Width = 60
+	}
+	m.addInputs[addFieldHost].Placeholder = "bastion.example.com"
+	m.addInputs[addFieldSubnets].Placeholder = "10.0.0.0/8, 172.16.0.0/12 (empty for default_subnets)"
+	m.addInputs[addFieldExtraArgs].Placeholder = "-i ~/.ssh/key.pem"
+	return tea.Batch(m.addInputs[addFieldName].Focus(), textinput.Blink)
+}
+
+// openEditForm shows the add form filled in from the config entry the
+// available tunnel i comes from. An entry with users lists them all in the
+// user field.
+func (m *model) openEditForm(i item) tea.Cmd {
+	config, err := loadOrCreateConfig()
+	if err != nil {
+		m.detail = fmt.Sprintf("Can't edit %s: %v", i.tunnel.Name, err)
+		m.logError(m.detail)
+		return nil
+	}
+	entry := configEntry(config, i.tunnel.Name)
+	if entry < 0 {
+		m.detail = fmt.Sprintf("Can't edit %s: it is no longer in the config", i.tunnel.Name)
+		return nil
+	}
+
+	cmd := m.openAddForm()
+	m.editTunnel = config.Tunnels[entry]
+	m.editName = m.editTunnel.Name
+	m.editUser = i.tunnel.User
+	values := []string{m.editTunnel.Name, m.editTunnel.Host, m.editTunnel.User, m.editTunnel.Subnets, m.editTunnel.ExtraArgs.String()}
+	if len(m.editTunnel.Users) > 0 {
+		values[addFieldUser] = strings.Join(m.editTunnel.Users, ", ")
+	}
+	for field, value := range values {
+		m.addInputs[field].SetValue(value)
+	}
+	return cmd
+}
+
+// focusAddField moves the add form cursor to field, wrapping around at
+// either end.
+func (m *model) focusAddField(field int) tea.Cmd {
+	m.addInputs[m.addFocus].Blur()
+	m.addFocus = (field + len(m.addInputs)) % len(m.addInputs)
+	return m.addInputs[m.addFocus].Focus()
+}
+
+// updateAddForm handles keys while the add tunnel form is open. Tab and
+// shift+tab move between fields, enter moves on and saves from the last
+// field, esc closes the form without saving.
+func (m model) updateAddForm(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "ctrl+c", "esc":
+		m.adding = false
+		m.addErr = ""
+		return m, nil
+	case "tab", "down":
+		return m, m.focusAddField(m.addFocus + 1)
+	case "shift+tab", "up":
+		return m, m.focusAddField(m.addFocus - 1)
+	case "enter":
+		if m.addFocus < len(m.addInputs)-1 {
+			return m, m.focusAddField(m.addFocus + 1)
+		}
+		return m.submitAddForm()
+	}
+
+	var cmd tea.Cmd
+	m.addInputs[m.addFocus], cmd = m.addInputs[m.addFocus].Update(msg)
+	return m, cmd
+}
+
+// submitAddForm saves the tunnel entered in the add form and reloads the
+// list with it highlighted. Problems, such as a name that is already
+// taken, are shown in the form, which stays open. Unlike -add, ssh
+// connectivity isn't checked; the test key does that.
+func (m model) submitAddForm() (tea.Model, tea.Cmd) {
+	value := func(field int) string {
+		return strings.TrimSpace(m.addInputs[field].Value())
+	}
+	for _, field := range []int{addFieldName, addFieldHost, addFieldUser} {
+		if value(field) == "" {
+			m.addErr = addFormFields[field] + " is required"
+			return m, m.focusAddField(field)
+		}
+	}
+	if subnets := value(addFieldSubnets); subnets != "" {
+		if err := validateSubnets(subnets); err != nil {
+			m.addErr = fmt.Sprintf("Invalid subnets: %v", err)
+			return m, m.focusAddField(addFieldSubnets)
+		}
+	}
+	if m.editName != "" {
+		return m.submitEditForm()
+	}
+
+	tunnel, notes, warnings, err := prepareNewTunnel(TunnelConfig{
+		Name:      value(addFieldName),
+		Host:      value(addFieldHost),
+		User:      value(addFieldUser),
+		Subnets:   value(addFieldSubnets),
+		ExtraArgs: ExtraArgs{Line: value(addFieldExtraArgs)},
+	})
+	if err == nil {
+		err = addTunnelToConfig(tunnel)
+	}
+	if err != nil {
+		m.addErr = fmt.Sprintf("Can't add: %v", err)
+		m.logError(m.addErr)
+		return m, nil
+	}
+
+	m.adding = false
+	m.reloadItems()
+	m.selectTunnel(tunnel.Name)
+	m.detail = strings.Join(append([]string{"Added " + tunnel.Name}, notes...), ". ")
+	m.warnings = append(m.warnings, warnings...)
+	return m, nil
+}
+
+// submitEditForm saves the form over the config entry being edited,
+// keeping the fields the form doesn't show, and reloads the list with the
+// entry still highlighted. Renaming it to a name that is taken is refused.
+func (m model) submitEditForm() (tea.Model, tea.Cmd) {
+	value := func(field int) string {
+		return strings.TrimSpace(m.addInputs[field].Value())
+	}
+	users := strings.FieldsFunc(value(addFieldUser), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	if len(users) == 0 {
+		m.addErr = addFormFields[addFieldUser] + " is required"
+		return m, m.focusAddField(addFieldUser)
+	}
+
+	// Validate as a new tunnel for the first user
+	edited := m.editTunnel
+	edited.Name = value(addFieldName)
+	edited.Host = value(addFieldHost)
+	edited.User = users[0]
+	edited.Users = nil
+	edited.Subnets = value(addFieldSubnets)
+	edited, notes, warnings, err := prepareNewTunnel(edited)
+	for _, user := range users[1:] {
+		if err == nil {
+			err = validateUserHost(user, edited.Host)
+		}
+	}
+	if err == nil && (len(m.editTunnel.Users) > 0 || len(users) > 1) {
+		edited.User = ""
+		edited.Users = users
+	}
+
+	extraArgs := value(addFieldExtraArgs)
+	if err == nil {
+		err = updateConfig(func(config *Config) error {
+			entry := configEntry(config, m.editName)
+			if entry < 0 {
+				return fmt.Errorf("tunnel '%s' is no longer in the config", m.editName)
+			}
+			if existing, ok := findTunnel(config, edited.Name); ok && configEntry(config, existing.Name) != entry {
+				return fmt.Errorf("tunnel with name '%s' already exists", existing.Name)
+			}
+			tunnel := &config.Tunnels[entry]
+			tunnel.Name = edited.Name
+			tunnel.Host = edited.Host
+			tunnel.User = edited.User
+			tunnel.Users = edited.Users
+			tunnel.Subnets = edited.Subnets
+			// An unchanged list form stays a list
+			if extraArgs != tunnel.ExtraArgs.String() {
+				tunnel.ExtraArgs = ExtraArgs{Line: extraArgs}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		m.addErr = fmt.Sprintf("Can't save: %v", err)
+		m.logError(m.addErr)
+		return m, nil
+	}
+
+	m.adding = false
+	index := m.list.Index()
+	m.reloadItems()
+	name := edited.Name
+	if len(edited.Users) > 0 {
+		user := edited.Users[0]
+		if containsString(edited.Users, m.editUser) {
+			user = m.editUser
+		}
+		name = fmt.Sprintf("%s (%s)", edited.Name, user)
+	}
+	if !m.selectTunnel(name) {
+		m.list.Select(index)
+		m.ensureSelectable()
+	}
+	m.detail = strings.Join(append([]string{"Saved " + edited.Name}, notes...), ". ")
+	m.warnings = append(m.warnings, warnings...)
+	return m, nil
+}
+
+// deleteTunnel removes the available tunnel i from the config and reloads
+// the list. For an entry with users, only i's user is removed, unless it
+// is the last one. A running tunnel is left running.
+func (m model) deleteTunnel(i item) (tea.Model, tea.Cmd) {
+	err := updateConfig(func(config *Config) error {
+		entry := configEntry(config, i.tunnel.Name)
+		if entry < 0 {
+			return fmt.Errorf("it is no longer in the config")
+		}
+		tunnel := &config.Tunnels[entry]
+		if len(tunnel.Users) > 1 {
+			var users []string
+			for _, user := range tunnel.Users {
+				if strings.TrimSpace(user) != i.tunnel.User {
+					users = append(users, user)
+				}
+			}
+			if len(users) > 0 {
+				tunnel.Users = users
+				return nil
+			}
+		}
+		config.Tunnels = append(config.Tunnels[:entry], config.Tunnels[entry+1:]...)
+		return nil
+	})
+	if err != nil {
+		m.detail = fmt.Sprintf("Can't delete %s: %v", i.tunnel.Name, err)
+		m.logError(m.detail)
+		return m, nil
+	}
+
+	index := m.list.Index()
+	m.reloadItems()
+	m.list.Select(index)
+	m.ensureSelectable()
+	m.detail = "Deleted " + i.tunnel.Name
+	if i.running {
+		m.detail += ". It is still running, listed under ORPHANED TUNNELS"
+	}
+	return m, nil
+}
+
+// selectTunnel moves the cursor to the available tunnel called name,
+// reporting whether it is listed.
+func (m *model) selectTunnel(name string) bool {
+	for idx, listItem := range m.list.VisibleItems() {
+		if i, ok := listItem.(item); ok && i.itemType == ItemAvailableTunnel && !i.paused && i.tunnel.Name == name {
+			m.list.Select(idx)
+			return true
+		}
+	}
+	return false
+}
+
+func (m model) View() string {
+	if m.choice != "" {
+		if m.chosen.routesAll {
+			return dangerItemStyle.Render(allTrafficWarning(m.chosen.destination)) + "\n" + quitTextStyle.Render(m.choice)
+		}
+		return quitTextStyle.Render(m.choice)
+	}
+	if m.quitting {
+		return quitTextStyle.Render("Goodbye!")
+	}
+
+	// Size is unknown until the first WindowSizeMsg arrives
+	if m.width > 0 && (m.width < minWidth || m.height < minHeight) {
+		return fmt.Sprintf("Terminal too small (%dx%d).\nResize to at least %dx%d.", m.width, m.height, minWidth, minHeight)
+	}
+
+	if m.showErrors {
+		return titleStyle.Render("Recent errors") + "\n" + m.errorView.View() + "\n" +
+			helpStyle.Render("↑/↓ scroll • esc close")
+	}
+
+	if m.previewing {
+		return titleStyle.Render("Routes for "+m.previewItem.tunnel.Name) + "\n" + m.previewText + "\n" +
+			helpStyle.Render("enter connect • esc cancel")
+	}
+
+	if m.adding {
+		title := "Add tunnel"
+		if m.editName != "" {
+			title = "Edit " + m.editName
+		}
+		view := titleStyle.Render(title) + "\n"
+		for idx, label := range addFormFields {
+			view += fmt.Sprintf("  %-11s %s\n", label, m.addInputs[idx].View())
+		}
+		if m.addErr != "" {
+			view += warningStyle.Render("⚠ "+m.addErr) + "\n"
+		}
+		return view + helpStyle.Render("tab/shift+tab move • enter next, save on the last field • esc cancel")
+	}
+
+	if m.rawStage != rawStageNone {
+		prompt := "Raw sshuttle command"
+		if m.rawStage == rawStageName {
+			prompt = "Save as tunnel named"
+		}
+		if m.rawStage == rawStageImport {
+			prompt = "Import tunnel as"
+		}
+		if m.rawStage == rawStageSubnets {
+			prompt = fmt.Sprintf("Subnets for %s (this connection only)", m.overrideItem.tunnel.Name)
+		}
+		view := titleStyle.Render(prompt) + "\n  " + m.rawInput.View() + "\n"
+		if m.rawErr != "" {
+			view += warningStyle.Render("⚠ "+m.rawErr) + "\n"
+		}
+		if m.rawStage == rawStageCommand {
+			return view + helpStyle.Render("enter confirm • tab complete recent destination • esc cancel")
+		}
+		return view + helpStyle.Render("enter confirm • esc cancel")
+	}
+
+	var help []string
+	for _, entry := range []struct{ action, label string }{
+		{"select", "select"},
+		{"command", "show command"},
+		{"subnets", "other subnets"},
+		{"preview", "preview routes"},
+		{"test", "test"},
+		{"pause", "pause/resume"},
+		{"import", "import orphan"},
+		{"details", "details"},
+		{"errors", "errors"},
+		{"add", "add"},
+		{"edit", "edit"},
+		{"delete", "delete"},
+		{"refresh", "refresh"},
+		{"kill-all", "kill all"},
+		{"quit", "quit"},
+	} {
+		if entry.action == "import" {
+			// Only relevant on an orphaned tunnel
+			if i, ok := m.list.SelectedItem().(item); !ok || !i.orphan {
+				continue
+			}
+		}
+		if key := m.keyHelp(entry.action); key != "" {
+			help = append(help, key+" "+entry.label)
+		}
+	}
+	if up, down := m.keyHelp("up"), m.keyHelp("down"); up != "" && down != "" {
+		help = append([]string{up + "/" + down + " navigate"}, help...)
+	}
+	helpText := helpStyle.Render(strings.Join(append(help, "/ search"), " • "))
+	if m.confirmingQuit {
+		helpText = warningStyle.Render("Tunnels are active. Quit anyway? [y/N]")
+	}
+	if m.deleting.name != "" {
+		prompt := fmt.Sprintf("Delete '%s'? [y/N]", m.deleting.tunnel.Name)
+		if m.deleting.running {
+			prompt = fmt.Sprintf("'%s' is running and won't be stopped. Delete it anyway? [y/N]", m.deleting.tunnel.Name)
+		}
+		helpText = warningStyle.Render(prompt)
+	}
+
+	view := m.list.View() + "\n"
+	if m.detail != "" {
+		view += statusStyle.MarginLeft(2).Width(m.list.Width()-4).Render(m.detail) + "\n"
+	}
+	if m.testing != "" {
+		view += statusStyle.MarginLeft(2).Render(fmt.Sprintf("%s Testing %s...", m.spinner.View(), m.testing)) + "\n"
+	} else if m.testResult != "" {
+		view += lipgloss.NewStyle().MarginLeft(2).Width(m.list.Width()-4).Render(m.testResult) + "\n"
+	}
+	for _, w := range m.warnings {
+		view += warningStyle.Render("⚠ "+w) + "\n"
+	}
+
+	return view + helpText
+}
+
+// process is a running process and its argv, see listProcesses.
+type process struct {
+	PID  int
+	Argv []string
+}
+
+// listProcesses returns the running processes from /proc on Linux and from
+// ps elsewhere. It is a variable so the process table can be swapped for
+// synthetic argv.
+var listProcesses = func() ([]process, error) {
+	if runtime.GOOS == "linux" {
+		if processes, err := procProcesses("/proc"); err == nil {
+			return processes, nil
+		}
+	}
+	return psProcesses()
+}
+
+// procProcesses reads the argv of every process under root, a /proc
+// mount. Processes that exit meanwhile and kernel threads, which have no
+// argv, are left out.
+func procProcesses(root string) ([]process, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var processes []process
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(root, entry.Name(), "cmdline"))
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		argv := strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+		processes = append(processes, process{PID: pid, Argv: argv})
+	}
+	return processes, nil
+}
+
+// psProcesses lists processes with ps, asking for the columns explicitly
+// so their order doesn't depend on the platform. ps joins argv with
+// spaces, so arguments containing spaces come back split.
+func psProcesses() ([]process, error) {
+	output, err := exec.Command("ps", "-axo", "pid=,command=").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var processes []process
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		processes = append(processes, process{PID: pid, Argv: fields[1:]})
+	}
+	return processes, nil
+}
+
+// interpreterRe matches the programs sshuttle runs under: Python, or a
+// shell for wrapper scripts.
+var interpreterRe = regexp.MustCompile(`^(python[0-9.]*|sh|bash)$`)
+
+// runsSshuttle reports whether argv runs the sshuttle executable, directly,
+// as a script given to Python or a shell, or as python -m sshuttle.
+// Processes that merely mention sshuttle in their arguments, such as grep,
+// an editor or the sh -c wrapper tunnels are started with, don't count.
+func runsSshuttle(argv []string) bool {
+	if len(argv) == 0 {
+		return false
+	}
+	if filepath.Base(argv[0]) == "sshuttle" {
+		return true
+	}
+	if !interpreterRe.MatchString(filepath.Base(argv[0])) {
+		return false
+	}
+	for i := 1; i < len(argv); i++ {
+		switch {
+		case argv[i] == "-m":
+			return i+1 < len(argv) && argv[i+1] == "sshuttle"
+		case argv[i] == "-c":
+			// A command string, not a script
+			return false
+		case strings.HasPrefix(argv[i], "-"):
+			// Interpreter options such as python's -u
+		default:
+			return filepath.Base(argv[i]) == "sshuttle"
+		}
+	}
+	return false
+}
+
+// getActiveTunnels returns the running sshuttle clients, an empty slice
+// when there are none. sshuttle's own firewall helper has no remote and is
+// left out.
+func getActiveTunnels() ([]activeTunnel, error) {
+	processes, err := listProcesses()
+	if err != nil {
+		return nil, err
+	}
+
+	tunnels := []activeTunnel{}
+	for _, p := range processes {
+		if !runsSshuttle(p.Argv) {
+			continue
+		}
+
+		// Quote argv back into a command line that splitArgs undoes
+		quoted := make([]string, len(p.Argv))
+		for i, arg := range p.Argv {
+			quoted[i] = shellQuote(arg)
+		}
+		command := strings.Join(quoted, " ")
+
+		args, err := parseSshuttleArgs(command)
+		if err != nil || args.Remote == "" {
+			continue
+		}
+
+		tunnels = append(tunnels, activeTunnel{
+			PID:         p.PID,
+			Command:     command,
+			Destination: args.Remote,
+			Args:        args,
+			StartTime:   processStartTime(p.PID),
+		})
+	}
+
+	return tunnels, nil
+}
+
+// processStartTime returns when pid started, from /proc on Linux and
+// derived from the elapsed time ps reports elsewhere, or the zero time if
+// it can't be read.
+func processStartTime(pid int) time.Time {
+	if runtime.GOOS == "linux" {
+		if start, err := procStartTime("/proc", pid); err == nil {
+			return start
+		}
+	}
+
+	output, err := exec.Command("ps", "-o", "etime=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return time.Time{}
+	}
+
+	elapsed, err := parseElapsed(strings.TrimSpace(string(output)))
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Now().Add(-elapsed).Truncate(time.Second)
+}
+
+// parseElapsed parses ps etime output in the form [[dd-]hh:]mm:ss.
+func parseElapsed(etime string) (time.Duration, error) {
+	var days int
+	if d, rest, found := strings.Cut(etime, "-"); found {
+		var err error
+		if days, err = strconv.Atoi(d); err != nil {
+			return 0, err
+		}
+		etime = rest
+	}
+
+	parts := strings.Split(etime, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("unexpected elapsed time %q", etime)
+	}
+
+	var seconds int
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, err
+		}
+		seconds = seconds*60 + n
+	}
+
+	return time.Duration(days)*24*time.Hour + time.Duration(seconds)*time.Second, nil
+}
+
+// clockTicks is the kernel's USER_HZ, the unit of process start times in
+// /proc. It is 100 on every common Linux build.
+const clockTicks = 100
+
+// procStartTime reads when pid started from its stat file under root, a
+// /proc mount: the start time in clock ticks after boot, plus the boot
+// time from root/stat.
+func procStartTime(root string, pid int) (time.Time, error) {
+	data, err := os.ReadFile(filepath.Join(root, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	// The command name in parentheses may contain spaces; starttime is
+	// the 22nd field, the 20th after it
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("unexpected stat format for PID %d", pid)
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	data, err = os.ReadFile(filepath.Join(root, "stat"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "btime "); ok {
+			boot, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(boot+ticks/clockTicks, 0), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no boot time in %s", filepath.Join(root, "stat"))
+}
+
+// formatUptime renders d compactly, e.g. 45s, 12m, 2h13m or 3d4h.
+func formatUptime(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+	default:
+		return fmt.Sprintf("%dd%dh", int(d.Hours())/24, int(d.Hours())%24)
+	}
+}
+
+// handleStatusCommand prints running tunnels, oldest first, optionally
+// only those that have been up for longer than olderThan.
+func handleStatusCommand(olderThan time.Duration, countOnly, asJSON bool) error {
+	tunnels, err := getActiveTunnels()
+	if err != nil {
+		return fmt.Errorf("failed to list tunnels: %v", err)
+	}
+
+	// Unknown start times sort last
+	sort.SliceStable(tunnels, func(a, b int) bool {
+		ta, tb := tunnels[a].StartTime, tunnels[b].StartTime
+		if ta.IsZero() || tb.IsZero() {
+			return !ta.IsZero() && tb.IsZero()
+		}
+		return ta.Before(tb)
+	})
+
+	// Tunnels with unknown start times can't be shown to be old enough
+	var shown []activeTunnel
+	for _, tunnel := range tunnels {
+		if olderThan > 0 && (tunnel.StartTime.IsZero() || time.Since(tunnel.StartTime) < olderThan) {
+			continue
+		}
+		shown = append(shown, tunnel)
+	}
+
+	if countOnly {
+		fmt.Println(len(shown))
+		return nil
+	}
+
+	if asJSON {
+		status := StatusJSON{Version: jsonSchemaVersion, Tunnels: []ActiveTunnelJSON{}}
+		for _, tunnel := range shown {
+			entry := ActiveTunnelJSON{
+				PID:         tunnel.PID,
+				Destination: tunnel.Destination,
+				Subnets:     append([]string{}, tunnel.Args.Subnets...),
+				Command:     tunnel.Command,
+			}
+			if !tunnel.StartTime.IsZero() {
+				entry.StartedAt = tunnel.StartTime.Format(time.RFC3339)
+				entry.UptimeSeconds = int64(time.Since(tunnel.StartTime).Seconds())
+			}
+			status.Tunnels = append(status.Tunnels, entry)
+		}
+		return printJSON(status)
+	}
+
+	fmt.Printf("%-8s %-36s %s\n", "PID", "DESTINATION", "UPTIME")
+	for _, tunnel := range shown {
+		uptime := "-"
+		if !tunnel.StartTime.IsZero() {
+			uptime = formatUptime(time.Since(tunnel.StartTime))
+		}
+		fmt.Printf("%-8d %-36s %s\n", tunnel.PID, tunnel.Destination, uptime)
+	}
+
+	if len(shown) == 1 {
+		fmt.Println("\n1 active tunnel")
+	} else {
+		fmt.Printf("\n%d active tunnels\n", len(shown))
+	}
+
+	return nil
+}
+
+// handleHealthCommand connects through every active tunnel to an address
+// in its subnets and reports whether traffic gets through, failing if any
+// tunnel is unhealthy. A refused connection still crossed the tunnel.
+func handleHealthCommand() error {
+	activeTunnels, err := getActiveTunnels()
+	if err != nil {
+		return fmt.Errorf("failed to list tunnels: %v", err)
+	}
+	if len(activeTunnels) == 0 {
+		fmt.Println("No active tunnels.")
+		return nil
+	}
+
+	// The config only supplies probe_address, so it is optional here
+	var configured []TunnelConfig
+	if config, err := loadOrCreateConfig(); err == nil {
+		configured = expandUsers(config.Tunnels)
+	}
+
+	results := make([]batchResult, len(activeTunnels))
+	var wg sync.WaitGroup
+	for idx, tunnel := range activeTunnels {
+		wg.Add(1)
+		go func(idx int, tunnel activeTunnel) {
+			defer wg.Done()
+			name := fmt.Sprintf("%s (PID %d)", tunnel.Destination, tunnel.PID)
+			target := healthTarget(tunnel, configured)
+			if target == "" {
+				results[idx] = batchResult{name, "skipped", "routes all traffic, set probe_address to check it"}
+				return
+			}
+			conn, err := net.DialTimeout("tcp", target, healthTimeout)
+			switch {
+			case err == nil:
+				conn.Close()
+				results[idx] = batchResult{name, "healthy", target}
+			case errors.Is(err, syscall.ECONNREFUSED):
+				results[idx] = batchResult{name, "healthy", target + " (refused)"}
+			default:
+				results[idx] = batchResult{name, "unhealthy", fmt.Sprintf("%s: %v", target, err)}
+			}
+		}(idx, tunnel)
+	}
+	wg.Wait()
+
+	if unhealthy := printBatchSummary(results)["unhealthy"]; unhealthy > 0 {
+		return fmt.Errorf("%d of %d tunnels unhealthy", unhealthy, len(results))
+	}
+	return nil
+}
+
+// healthTarget returns the host:port -health connects to through tunnel:
+// the probe_address of the configured tunnel to the same destination, or
+// the first host of its first subnet. It returns "" for a tunnel that
+// routes everything and has no probe_address.
+func healthTarget(tunnel activeTunnel, configured []TunnelConfig) string {
+	for _, c := range configured {
+		if c.ProbeAddress != "" && c.User+"@"+c.Host == tunnel.Destination {
+			return net.JoinHostPort(c.ProbeAddress, healthPort)
+		}
+	}
+
+	networks := parseSubnetList(strings.Join(tunnel.Args.Subnets, ","))
+	if len(networks) == 0 {
+		return ""
+	}
+	network := networks[0]
+	ones, bits := network.Mask.Size()
+	if ones == 0 {
+		return ""
+	}
+	ip := make(net.IP, len(network.IP))
+	copy(ip, network.IP)
+	if bits-ones > 1 {
+		// Skip the network address
+		ip[len(ip)-1]++
+	}
+	return net.JoinHostPort(ip.String(), healthPort)
+}
+
+// isDestinationActive reports whether a running tunnel already goes to
+// destination (user@host).
+func isDestinationActive(destination string) bool {
+	tunnels, err := getActiveTunnels()
+	if err != nil {
+		return false
+	}
+	for _, tunnel := range tunnels {
+		if tunnel.Destination == destination {
+			return true
+		}
+	}
+	return false
+}
+
+// killTunnel stops pid, the tunnel to destination started from the
+// configured tunnel name, and records it in the activity log. A tunnel
+// started with sudo belongs to root, so when kill isn't permitted it is
+// retried with sudo, which must not need to prompt for it.
+func killTunnel(pid int, name, destination string) error {
+	err := exec.Command("kill", strconv.Itoa(pid)).Run()
+	if err != nil && os.Geteuid() != 0 {
+		if privilegedCommand(false, "kill", strconv.Itoa(pid)).Run() == nil {
+			err = nil
+		} else {
+			err = fmt.Errorf("%v (if it runs as root, stop it with: sudo kill %d)", err, pid)
+		}
+	}
+	if err != nil {
+		logActivity("stop", name, destination, pid, err.Error())
+	} else {
+		logActivity("stop", name, destination, pid, "ok")
+	}
+	return err
+}
+
+// activeTunnelNames returns the name of the configured tunnel each of
+// tunnels was started from, "" for those started elsewhere or when the
+// config can't be read.
+func activeTunnelNames(tunnels []activeTunnel) []string {
+	names := make([]string, len(tunnels))
+	config, err := loadListConfig()
+	if err != nil {
+		return names
+	}
+	configItems, _ := configTunnelItems(config)
+	for idx, match := range matchActiveTunnels(tunnels, configItems) {
+		if match >= 0 {
+			names[idx] = configItems[match].(item).tunnel.Name
+		}
+	}
+	return names
+}
+
+// stopActiveTunnel kills the tunnel listed with pid after checking that the
+// process is still sshuttle to destination, so a PID reused since the list
+// was loaded is never killed.
+func stopActiveTunnel(pid int, destination string) error {
+	tunnels, err := getActiveTunnels()
+	if err != nil {
+		return fmt.Errorf("failed to list tunnels: %v", err)
+	}
+	for idx, tunnel := range tunnels {
+		if tunnel.PID == pid {
+			if tunnel.Destination != destination {
+				return fmt.Errorf("PID %d is now a tunnel to %s, not %s", pid, tunnel.Destination, destination)
+			}
+			return killTunnel(pid, activeTunnelNames(tunnels[idx:idx+1])[0], destination)
+		}
+	}
+	return fmt.Errorf("%s (PID %d) is no longer running", destination, pid)
+}
+
+// waitForStop waits up to stopWait for a killed tunnel to exit. sshuttle
+// removes its firewall rules before exiting, which can take a moment.
+func waitForStop(pid int, destination string, paused bool) tea.Cmd {
+	return func() tea.Msg {
+		deadline := time.Now().Add(stopWait)
+		for {
+			exited := true
+			if tunnels, err := getActiveTunnels(); err == nil {
+				for _, tunnel := range tunnels {
+					if tunnel.PID == pid {
+						exited = false
+					}
+				}
+			}
+			if exited || time.Now().After(deadline) {
+				return tunnelStoppedMsg{destination: destination, pid: pid, exited: exited, paused: paused}
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+	}
+}
+
+// handleStopCommand stops every running tunnel, reporting each one. It
+// fails if any could not be stopped.
+func handleStopCommand() error {
+	tunnels, err := getActiveTunnels()
+	if err != nil {
+		return fmt.Errorf("failed to list tunnels: %v", err)
+	}
+	if len(tunnels) == 0 {
+		fmt.Println("No tunnels are running.")
+		return nil
+	}
+
+	names := activeTunnelNames(tunnels)
+	failed := 0
+	for idx, tunnel := range tunnels {
+		if err := killTunnel(tunnel.PID, names[idx], tunnel.Destination); err != nil {
+			fmt.Printf("Failed to stop %s (PID %d): %v\n", tunnel.Destination, tunnel.PID, err)
+			failed++
+			continue
+		}
+		fmt.Printf("Stopped %s (PID %d)\n", tunnel.Destination, tunnel.PID)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tunnels could not be stopped", failed, len(tunnels))
+	}
+	return nil
+}
+
+func killAllTunnels() error {
+	tunnels, err := getActiveTunnels()
+	if err != nil {
+		return err
+	}
+
+	names := activeTunnelNames(tunnels)
+	for idx, tunnel := range tunnels {
+		if err := killTunnel(tunnel.PID, names[idx], tunnel.Destination); err != nil {
+			log.Printf("Failed to kill tunnel %d: %v", tunnel.PID, err)
+		}
+	}
+
+	return nil
+}
+
+// privilegedCommand builds a command that needs root, going through sudo
+// when we aren't root already. Non-interactive sudo (-n) never prompts and
+// fails instead, which is what background checks want.
+func privilegedCommand(interactive bool, args ...string) *exec.Cmd {
+	if os.Geteuid() == 0 {
+		return exec.Command(args[0], args[1:]...)
+	}
+	if interactive {
+		return exec.Command("sudo", args...)
+	}
+	return exec.Command("sudo", append([]string{"-n"}, args...)...)
+}
+
+// staleFirewallRules looks for firewall rules installed by sshuttle
+// (iptables/nftables on Linux, its pf anchors on macOS). It returns the rules
+// for display and the commands that remove them. Rules that can't be read
+// are treated as absent.
+func staleFirewallRules(interactive bool) ([]string, [][]string) {
+	var rules []string
+	var cleanup [][]string
+
+	switch runtime.GOOS {
+	case "linux":
+		for _, tool := range []string{"iptables", "ip6tables"} {
+			for _, table := range []string{"nat", "mangle"} {
+				output, err := privilegedCommand(interactive, tool, "-t", table, "-S").Output()
+				if err != nil {
+					continue
+				}
+
+				var chains []string
+				for _, line := range strings.Split(string(output), "\n") {
+					if !strings.Contains(line, "sshuttle-") {
+						continue
+					}
+					rules = append(rules, fmt.Sprintf("%s -t %s %s", tool, table, line))
+
+					fields := strings.Fields(line)
+					switch {
+					case len(fields) == 2 && fields[0] == "-N":
+						chains = append(chains, fields[1])
+					case len(fields) > 2 && fields[0] == "-A" && !strings.HasPrefix(fields[1], "sshuttle-"):
+						// Jump from a built-in chain into one of sshuttle's
+						cleanup = append(cleanup, append([]string{tool, "-t", table, "-D"}, fields[1:]...))
+					}
+				}
+
+				// Chains can only be deleted once nothing jumps to them
+				for _, chain := range chains {
+					cleanup = append(cleanup,
+						[]string{tool, "-t", table, "-F", chain},
+						[]string{tool, "-t", table, "-X", chain})
+				}
+			}
+		}
+
+		if output, err := privilegedCommand(interactive, "nft", "list", "tables").Output(); err == nil {
+			for _, line := range strings.Split(string(output), "\n") {
+				// e.g. "table ip sshuttle-ipv4-12300"
+				fields := strings.Fields(line)
+				if len(fields) == 3 && fields[0] == "table" && strings.HasPrefix(fields[2], "sshuttle") {
+					rules = append(rules, "nft "+line)
+					cleanup = append(cleanup, []string{"nft", "delete", "table", fields[1], fields[2]})
+				}
+			}
+		}
+
+	case "darwin":
+		for _, anchor := range []string{"sshuttle", "sshuttle6"} {
+			output, err := privilegedCommand(interactive, "pfctl", "-a", anchor, "-s", "rules").Output()
+			if err != nil {
+				continue
+			}
+
+			found := false
+			for _, line := range strings.Split(string(output), "\n") {
+				if strings.TrimSpace(line) != "" {
+					rules = append(rules, fmt.Sprintf("pf anchor %s: %s", anchor, line))
+					found = true
+				}
+			}
+			if found {
+				cleanup = append(cleanup, []string{"pfctl", "-a", anchor, "-F", "all"})
+			}
+		}
+	}
+
+	return rules, cleanup
+}
+
+// handleCleanupCommand offers to remove firewall rules left behind by an
+// sshuttle process that crashed.
+func handleCleanupCommand() error {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		return fmt.Errorf("cleanup is only supported on Linux and macOS")
+	}
+
+	tunnels, err := getActiveTunnels()
+	if err != nil {
+		return fmt.Errorf("failed to check running tunnels: %v", err)
+	}
+	if len(tunnels) > 0 {
+		return fmt.Errorf("sshuttle is still running (PID %d), stop it before cleaning up", tunnels[0].PID)
+	}
+
+	rules, cleanup := staleFirewallRules(true)
+	if len(rules) == 0 {
+		fmt.Println("No stale sshuttle firewall rules found.")
+		return nil
+	}
+
+	fmt.Println("Stale sshuttle firewall rules:")
+	for _, rule := range rules {
+		fmt.Printf("  %s\n", rule)
+	}
+
+	fmt.Print("Flush them? [y/N]: ")
+	var response string
+	fmt.Scanln(&response)
+	if strings.ToLower(response) != "y" && strings.ToLower(response) != "yes" {
+		return fmt.Errorf("operation cancelled")
+	}
+
+	failed := 0
+	for _, args := range cleanup {
+		cmd := privilegedCommand(true, args...)
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Printf("Failed: %s: %v\n", strings.Join(args, " "), err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d cleanup commands failed", failed)
+	}
+
+	return nil
+}
+
+// loadAllItems builds the list from config, which loadListConfig loaded,
+// and the running tunnels.
+func loadAllItems(config *Config) ([]list.Item, []string) {
+	var items []list.Item
+
+	// Get active tunnels, several when additive tunnels are running
+	activeTunnels, err := getActiveTunnels()
+	if err != nil {
+		log.Printf("Error getting active tunnels: %v", err)
+	}
+
+	// Remember destinations of tunnels started elsewhere too
+	var destinations []string
+	for _, tunnel := range activeTunnels {
+		destinations = append(destinations, tunnel.Destination)
+	}
+	recordDestinations(destinations...)
+
+	// Build config tunnels
+	configItems, warnings := configTunnelItems(config)
+	for idx, tunnel := range activeTunnels {
+		warnings = append(warnings, overlapWarnings(tunnel.Destination, strings.Join(tunnel.Args.Subnets, ","), activeTunnels[idx+1:])...)
+	}
+
+	// Tunnels started outside the selector (ad-hoc or left over) match no
+	// configured tunnel and are listed separately
+	var current, orphans []item
+	for idx, match := range matchActiveTunnels(activeTunnels, configItems) {
+		if match < 0 {
+			orphans = append(orphans, activeTunnelItem(activeTunnels[idx], ""))
+			continue
+		}
+		configured := configItems[match].(item)
+		configured.running = true
+		configItems[match] = configured
+		current = append(current, activeTunnelItem(activeTunnels[idx], configured.name))
+	}
+
+	// Add current active tunnels (if any), each stopped on its own
+	if len(current) > 0 {
+		header := "CURRENT TUNNEL"
+		if len(current) > 1 {
+			header = "CURRENT TUNNELS"
+		}
+		items = append(items, item{
+			name:     header,
+			itemType: ItemAction,
+			command:  "",
+		})
+
+		for _, tunnel := range current {
+			items = append(items, tunnel)
+		}
+
+		// Add separator
+		items = append(items, item{
+			name:     "",
+			itemType: ItemAction,
+			command:  "",
+		})
+	}
+
+	if len(orphans) > 0 {
+		items = append(items, item{
+			name:     "ORPHANED TUNNELS",
+			itemType: ItemAction,
+			command:  "",
+		})
+		for _, tunnel := range orphans {
+			items = append(items, tunnel)
+		}
+		items = append(items, item{
+			name:     "",
+			itemType: ItemAction,
+			command:  "",
+		})
+	}
+
+	// Paused tunnels, unless they were started again meanwhile
+	if state, err := loadState(); err == nil {
+		running := make(map[string]bool)
+		for _, tunnel := range activeTunnels {
+			running[tunnel.Destination] = true
+		}
+		var paused []list.Item
+		for _, tunnel := range state.Paused {
+			if !running[tunnel.Destination] {
+				paused = append(paused, pausedTunnelItem(tunnel, configItems))
+			}
+		}
+		if len(paused) > 0 {
+			items = append(items, item{
+				name:     "PAUSED TUNNELS",
+				itemType: ItemAction,
+				command:  "",
+			})
+			items = append(items, paused...)
+			items = append(items, item{
+				name:     "",
+				itemType: ItemAction,
+				command:  "",
+			})
+		}
+	}
+
+	if len(configItems) == 0 {
+		// No section to show, just the way to add a tunnel
+		items = append(items, item{
+			name:     "No tunnels configured: press a to add one, or run with -init for an example config",
+			itemType: ItemAction,
+			command:  "add_new",
+		})
+	} else {
+		items = append(items, availableSections(configItems)...)
+
+		// Add separator and new tunnel option
+		items = append(items, item{
+			name:     "",
+			itemType: ItemAction,
+			command:  "",
+		})
+		items = append(items, item{
+			name:     "+ Add New Tunnel",
+			itemType: ItemAction,
+			command:  "add_new",
+		})
+	}
+	if !sshMode {
+		items = append(items, item{
+			name:     "+ Run Raw Command",
+			itemType: ItemAction,
+			command:  "raw_command",
+		})
+	}
+
+	return items, warnings
+}
+
+// activeTunnelDetails summarizes the parsed command line and uptime of an
+// active tunnel for the verbose list.
+func activeTunnelDetails(tunnel activeTunnel, latency string) string {
+	subnets := strings.Join(tunnel.Args.Subnets, ",")
+	if subnets == "" {
+		subnets = "no subnets"
+	}
+	details := []string{subnets}
+	if tunnel.Args.Daemon {
+		details = append(details, "daemon")
+	} else {
+		details = append(details, "foreground")
+	}
+	if latency != "" {
+		details = append(details, latency)
+	}
+	return "[" + strings.Join(details, " • ") + "]"
+}
+
+// latencyHost returns the host:port of destination that latency is
+// measured against, port 22 unless the host names one.
+func latencyHost(destination string) string {
+	host := destination
+	if at := strings.LastIndex(host, "@"); at >= 0 {
+		host = host[at+1:]
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, "22")
+}
+
+// measureLatency times a TCP connect to each address in parallel,
+// returning "12ms" or "unreachable" per address.
+func measureLatency(addresses []string) map[string]string {
+	results := make(map[string]string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, address := range addresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			result := "unreachable"
+			start := time.Now()
+			if conn, err := net.DialTimeout("tcp", address, latencyTimeout); err == nil {
+				conn.Close()
+				result = fmt.Sprintf("%dms", time.Since(start).Milliseconds())
+			}
+			mu.Lock()
+			results[address] = result
+			mu.Unlock()
+		}(address)
+	}
+	wg.Wait()
+	return results
+}
+
+// availableSections returns the AVAILABLE TUNNELS section or, once a
+// tunnel sets a group, a section per group such as PROD TUNNELS sorted by
+// name, with OTHER TUNNELS last. Tunnels keep their config order within a section.
+func availableSections(configItems []list.Item) []list.Item {
+	var tunnels []TunnelConfig
+	for _, configItem := range configItems {
+		if i, ok := configItem.(item); ok {
+			tunnels = append(tunnels, i.tunnel)
+		}
+	}
+	if !configGrouped(tunnels) {
+		return append([]list.Item{item{
+			name:     "AVAILABLE TUNNELS",
+			itemType: ItemAction,
+			command:  "",
+		}}, configItems...)
+	}
+
+	// Groups differing only in case are one section, named as first seen
+	var keys []string
+	names := make(map[string]string)
+	members := make(map[string][]list.Item)
+	for _, configItem := range configItems {
+		i, ok := configItem.(item)
+		if !ok {
+			continue
+		}
+		key := normalizeName(tunnelGroup(i.tunnel))
+		if _, ok := names[key]; !ok {
+			names[key] = tunnelGroup(i.tunnel)
+			keys = append(keys, key)
+		}
+		members[key] = append(members[key], configItem)
+	}
+	other := normalizeName(otherGroup)
+	sort.Slice(keys, func(a, b int) bool {
+		if (keys[a] == other) != (keys[b] == other) {
+			return keys[b] == other
+		}
+		return keys[a] < keys[b]
+	})
+
+	var items []list.Item
+	for idx, key := range keys {
+		if idx > 0 {
+			items = append(items, item{
+				name:     "",
+				itemType: ItemAction,
+				command:  "",
+			})
+		}
+		items = append(items, item{
+			name:     strings.ToUpper(names[key]) + " TUNNELS", // see isSelectableItem
+			itemType: ItemAction,
+			command:  "",
+		})
+		items = append(items, members[key]...)
+	}
+	return items
+}
+
+// activeTunnelItem builds the list item for a running tunnel, which stops
+// it when selected. configName is the configured tunnel it was started
+// from, empty for one started outside the selector.
+func activeTunnelItem(tunnel activeTunnel, configName string) item {
+	i := item{
+		destination: tunnel.Destination,
+		command:     fmt.Sprintf("kill %d", tunnel.PID),
+		itemType:    ItemActiveTunnel,
+		pid:         tunnel.PID,
+		fullCommand: tunnel.Command,
+		active:      tunnel,
+		configName:  configName,
+		orphan:      configName == "",
+	}
+	i.name = activeTunnelRow(i, "")
+	return i
+}
+
+// activeTunnelRow is the row of the active tunnel i, with uptime next to
+// its PID unless it is empty. Without uptime it is also the item's name,
+// which search matches.
+func activeTunnelRow(i item, uptime string) string {
+	details := fmt.Sprintf("PID: %d", i.pid)
+	if uptime != "" {
+		details += ", up " + uptime
+	}
+	return fmt.Sprintf("● %s (%s) - Click to stop", activeTunnelLabel(i), details)
+}
+
+// activeTunnelLabel names an active tunnel in its row: the configured
+// tunnel it was started from, or its destination marked external.
+func activeTunnelLabel(i item) string {
+	if i.configName != "" {
+		return i.configName
+	}
+	return i.destination + " [external]"
+}
+
+// matchActiveTunnels finds the configured tunnel each running tunnel was
+// started from, by user@host and, among tunnels sharing that, by subnets.
+// It returns an index into configItems per running tunnel, -1 for those
+// matching none.
+func matchActiveTunnels(activeTunnels []activeTunnel, configItems []list.Item) []int {
+	matches := make([]int, len(activeTunnels))
+	for a, tunnel := range activeTunnels {
+		matches[a] = -1
+		for c, configItem := range configItems {
+			i, ok := configItem.(item)
+			if !ok || i.destination != tunnel.Destination {
+				continue
+			}
+			if matches[a] < 0 {
+				matches[a] = c
+			}
+			if args, err := parseSshuttleArgs(i.command); err == nil && sameSubnets(args.Subnets, tunnel.Args.Subnets) {
+				matches[a] = c
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// sameSubnets reports whether a and b hold the same subnets in any order.
+func sameSubnets(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pausedTunnelItem builds the list item for a paused tunnel, which resumes
+// it when selected. The configured tunnel it was, if still listed, supplies
+// settings such as env and listen.
+func pausedTunnelItem(paused PausedTunnel, configItems []list.Item) item {
+	i := item{
+		name:        paused.Name,
+		destination: paused.Destination,
+		command:     paused.Command,
+		itemType:    ItemAvailableTunnel,
+		paused:      true,
+		pausedAt:    paused.PausedAt,
+	}
+	if i.name == "" {
+		i.name = paused.Destination
+	}
+	for _, configItem := range configItems {
+		if configured, ok := configItem.(item); ok && paused.Name != "" && configured.name == paused.Name {
+			i.tunnel = configured.tunnel
+			i.tunnel.Alias = "" // typing it jumps to the configured tunnel
+			break
+		}
+	}
+	if args, err := parseSshuttleArgs(paused.Command); err == nil {
+		i.routesAll = routesAllTraffic(strings.Join(args.Subnets, ","))
+	}
+	return i
+}
+
+// loadListConfig loads the config the TUI lists.
+func loadListConfig() (*Config, error) {
+	configPath, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if config file exists
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		return &Config{}, nil
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, configIOError(configPath, err)
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, configParseError(configPath, err)
+	}
+	setHostKeyChecking(&config)
+
+	return &config, nil
+}
+
+// configTunnelItems builds the list items of the tunnels in config.
+func configTunnelItems(config *Config) ([]list.Item, []string) {
+	// Skip tunnels whose user@host can't work rather than failing to connect
+	var warnings []string
+	var tunnels []TunnelConfig
+	for _, tunnel := range trimTunnels(expandUsers(config.Tunnels)) {
+		if err := validateUserHost(tunnel.User, tunnel.Host); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v, skipping", tunnel.Name, err))
+			continue
+		}
+		tunnels = append(tunnels, tunnel)
+	}
+
+	// Count names so duplicated entries can be told apart in the list
+	nameCounts := make(map[string]int)
+	displayNames := make(map[string]string)
+	for _, tunnel := range tunnels {
+		key := normalizeName(tunnel.Name)
+		nameCounts[key]++
+		if _, ok := displayNames[key]; !ok {
+			displayNames[key] = tunnel.Name
+		}
+	}
+
+	for key, count := range nameCounts {
+		if count > 1 {
+			warnings = append(warnings, fmt.Sprintf("Duplicate tunnel name '%s' (%d entries)", displayNames[key], count))
+		}
+	}
+	warnings = append(warnings, duplicateAliases(tunnels)...)
+	sort.Strings(warnings)
+
+	items := make([]list.Item, len(tunnels))
+	seen := make(map[string]int)
+	for i, tunnel := range tunnels {
+		tunnelItem, buildWarnings := newTunnelItem(tunnel)
+		warnings = append(warnings, buildWarnings...)
+
+		// Append an index to duplicated names
+		key := normalizeName(tunnel.Name)
+		seen[key]++
+		if nameCounts[key] > 1 {
+			tunnelItem.name = fmt.Sprintf("%s [%d]", tunnelItem.name, seen[key])
+		}
+
+		items[i] = tunnelItem
+	}
+
+	return items, warnings
+}
+
+// newTunnelItem builds the list item for a configured tunnel in the
+// current mode.
+func newTunnelItem(tunnel TunnelConfig) (item, []string) {
+	command, warnings := buildTunnelCommand(tunnel)
+	subnets, _ := tunnelSubnets(tunnel)
+
+	name := fmt.Sprintf("%s (%s)", tunnel.Name, tunnel.Host)
+	if tunnel.Alias != "" {
+		name = fmt.Sprintf("[%s] %s", tunnel.Alias, name)
+	}
+
+	return item{
+		name:        name,
+		destination: fmt.Sprintf("%s@%s", tunnel.User, tunnel.Host),
+		command:     command,
+		itemType:    ItemAvailableTunnel,
+		isSSHDirect: sshMode,
+		routesAll:   !sshMode && routesAllTraffic(subnets),
+		tunnel:      tunnel,
+	}, warnings
+}
+
+// buildTunnelCommand returns the command that connects tunnel: ssh to the
+// host in -ssh mode, sshuttle otherwise, honoring -debug. The list, -start
+// and -connect all run this command.
+func buildTunnelCommand(tunnel TunnelConfig) (string, []string) {
+	if sshMode {
+		// SSH direct connection mode
+		return fmt.Sprintf("%s %s@%s", buildSSHCommand(tunnel), tunnel.User, tunnel.Host), nil
+	}
+	return buildSshuttleCommand(tunnel)
+}
+
+// buildSSHCommand builds the ssh invocation used both for direct
+// connections and as sshuttle's --ssh-cmd.
+func buildSSHCommand(tunnel TunnelConfig) string {
+	// Build SSH command with key if specified
+	sshCmd := "ssh -o StrictHostKeyChecking=" + tunnelHostKeyChecking(tunnel)
+	// Problems are reported by buildSshuttleCommandWith
+	if args, _ := parseExtraArgs(tunnel.ExtraArgs.String()); args.identityFile != "" {
+		// The key from extra_args is ssh's, not sshuttle's. Under sudo
+		// ~ would be root's home, so it is expanded here.
+		keyPath := args.identityFile
+		if tunnelSudo(tunnel) {
+			keyPath = expandPath(keyPath)
+		}
+		sshCmd += " -i " + shellQuote(keyPath)
+	}
+
+	if proxyCommand := tunnelProxyCommand(tunnel); proxyCommand != "" {
+		sshCmd += fmt.Sprintf(" -o 'ProxyCommand=%s'", proxyCommand)
+	}
+
+	// Invalid options are reported by buildSshuttleCommandWith
+	options, _ := sshOptionPairs(tunnel.SSHOptions)
+	for _, option := range options {
+		if shellSafeRe.MatchString(option) {
+			sshCmd += " -o " + option
+		} else {
+			sshCmd += fmt.Sprintf(" -o '%s'", option)
+		}
+	}
+
+	// Add debug flags if in debug mode
+	if debugMode {
+		sshCmd += " -vvv"
+	}
+
+	return sshCmd
+}
+
+// tunnelSudo reports whether tunnel's sshuttle runs through sudo, which
+// is pointless when we are root already.
+func tunnelSudo(tunnel TunnelConfig) bool {
+	return (tunnel.Sudo || sudoMode) && geteuid() != 0
+}
+
+// geteuid is os.Geteuid, replaced in tests to build commands as a user
+// other than the one running them.
+var geteuid = os.Geteuid
+
+// buildSshuttleCommand builds the sshuttle command line for tunnel in the
+// current mode. Problems that don't prevent building it are returned as
+// warnings.
+func buildSshuttleCommand(tunnel TunnelConfig) (string, []string) {
+	// Debug output, detached and interactive tunnels need sshuttle in the
+	// foreground
+	return buildSshuttleCommandWith(tunnel, !debugMode && !detachMode && !tunnel.Interactive && foregroundTail == 0)
+}
+
+// buildSshuttleCommandWith builds the sshuttle command line for tunnel,
+// daemonized or in the foreground regardless of the current mode.
+func buildSshuttleCommandWith(tunnel TunnelConfig, daemon bool) (string, []string) {
+	var warnings []string
+	var command string
+
+	if err := validateProxyCommand(tunnel.ProxyCommand); err != nil {
+		warnings = append(warnings, fmt.Sprintf("%s: invalid proxy_command: %v", tunnel.Name, err))
+	}
+	if err := validateSSMInstance(tunnel); err != nil {
+		warnings = append(warnings, fmt.Sprintf("%s: %v", tunnel.Name, err))
+	}
+	if _, err := sshOptionPairs(tunnel.SSHOptions); err != nil {
+		warnings = append(warnings, fmt.Sprintf("%s: %v", tunnel.Name, err))
+	}
+	if err := validateHostKeyChecking(tunnel); err != nil {
+		warnings = append(warnings, fmt.Sprintf("%s: %v", tunnel.Name, err))
+	}
+	if err := validateProbe(tunnel); err != nil {
+		warnings = append(warnings, fmt.Sprintf("%s: %v", tunnel.Name, err))
+	}
+
+	subnets, subnetWarnings := tunnelSubnets(tunnel)
+	warnings = append(warnings, subnetWarnings...)
+	if err := validateFamily(tunnel.Family, ""); err != nil {
+		warnings = append(warnings, fmt.Sprintf("%s: %v", tunnel.Name, err))
+	}
+	subnets, mismatched := familySubnets(tunnel.Family, subnets)
+	for _, subnet := range mismatched {
+		warnings = append(warnings, fmt.Sprintf("%s: ignoring %s, it doesn't match family %s", tunnel.Name, subnet, tunnel.Family))
+	}
+
+	// sshuttle takes each subnet as its own argument, however they are
+	// stored
+	positional := strings.Join(splitSubnets(subnets), " ")
+	sshCmd := buildSSHCommand(tunnel)
+	if debugMode {
+		// In debug mode, don't use --daemon and add -v flag
+		command = fmt.Sprintf("sshuttle -v -r %s@%s %s --ssh-cmd=\"%s\"", tunnel.User, tunnel.Host, positional, sshCmd)
+		if daemon {
+			command += " --daemon"
+		}
+	} else if !daemon {
+		command = fmt.Sprintf("sshuttle -r %s@%s %s --ssh-cmd=\"%s\"", tunnel.User, tunnel.Host, positional, sshCmd)
+	} else {
+		// Normal mode uses --daemon
+		command = fmt.Sprintf("sshuttle -r %s@%s %s --daemon --ssh-cmd=\"%s\"", tunnel.User, tunnel.Host, positional, sshCmd)
+	}
+
+	// Keep the local network reachable when routing everything
+	if routesAllTraffic(subnets) {
+		local, _ := familySubnets(tunnel.Family, strings.Join(localSubnets(), ","))
+		for _, cidr := range splitSubnets(local) {
+			command += " -x " + cidr
+		}
+	}
+
+	// Flags the selector generates, or renders from structured fields, take
+	// precedence over the same flags repeated in extra_args. The value says
+	// whether the flag takes a separate argument.
+	structured := map[string]bool{
+		"-r": true, "--remote": true,
+		"-e": true, "--ssh-cmd": true,
+		"-D": false, "--daemon": false,
+	}
+
+	if tunnel.ExcludeFrom != "" {
+		if _, err := os.Stat(expandPath(tunnel.ExcludeFrom)); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: exclude-from file not found: %s", tunnel.Name, tunnel.ExcludeFrom))
+		}
+		command += " --exclude-from " + shellQuote(expandPath(tunnel.ExcludeFrom))
+		structured["--exclude-from"] = true
+	}
+
+	if tunnel.Exclude != "" {
+		if err := validateSubnets(tunnel.Exclude); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: ignoring exclude: %v", tunnel.Name, err))
+		} else {
+			for _, cidr := range splitSubnets(normalizeSubnets(tunnel.Exclude)) {
+				command += " -x " + cidr
+			}
+		}
+	}
+
+	if tunnel.DNS {
+		command += " --dns"
+		structured["--dns"] = false
+	}
+
+	if tunnel.NSHosts != "" {
+		if err := validateNSHosts(tunnel.NSHosts); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: ignoring ns_hosts: %v", tunnel.Name, err))
+		} else {
+			command += " --ns-hosts " + strings.Join(subnetFields(tunnel.NSHosts), ",")
+			structured["--ns-hosts"] = true
+		}
+	}
+
+	if tunnel.Listen != "" {
+		command += fmt.Sprintf(" --listen %s", tunnel.Listen)
+		structured["-l"] = true
+		structured["--listen"] = true
+	}
+
+	if tunnel.Method != "" {
+		if err := validateMethod(tunnel.Method); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v, letting sshuttle choose", tunnel.Name, err))
+		} else {
+			command += " --method " + tunnel.Method
+			structured["-m"] = true
+			structured["--method"] = true
+		}
+	}
+
+	if tunnel.Family == "4" {
+		command += " --disable-ipv6"
+		structured["--disable-ipv6"] = false
+	}
+
+	optionArgs, err := sshuttleOptionArgs(tunnel.Options)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("%s: %v", tunnel.Name, err))
+	}
+	for _, arg := range optionArgs {
+		command += " " + arg
+		flagName, _, hasValue := strings.Cut(arg, "=")
+		structured[flagName] = hasValue
+	}
+
+	// Add other extra args (excluding -i)
+	args, err := parseExtraArgs(tunnel.ExtraArgs.String())
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("%s: extra_args: %v", tunnel.Name, err))
+	}
+	if rest := args.restLine(); rest != "" {
+		extraArgs, dropped := dropFlags(rest, structured)
+		for _, flagName := range dropped {
+			warnings = append(warnings, fmt.Sprintf("%s: ignoring %s in extra_args, it is set by the selector", tunnel.Name, flagName))
+		}
+		if extraArgs != "" {
+			command += " " + extraArgs
+		}
+	}
+
+	// sudo resets the environment, so env is passed on through env(1),
+	// along with the ssh agent socket that ssh, now running as root,
+	// still needs for the user's keys
+	if tunnelSudo(tunnel) {
+		env := make(map[string]string)
+		if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+			env["SSH_AUTH_SOCK"] = socket
+		}
+		for key, value := range tunnel.Env {
+			env[key] = value
+		}
+		prefix := "sudo "
+		if assignments := envAssignments(env); len(assignments) > 0 {
+			for i, entry := range assignments {
+				assignments[i] = shellQuote(entry)
+			}
+			prefix += "env " + strings.Join(assignments, " ") + " "
+		}
+		command = prefix + command
+	}
+
+	return command, warnings
+}
+
+// tunnelSubnets returns the subnets tunnel routes: Subnets plus the valid
+// CIDRs read from SubnetsFrom. Problems with the file are returned as
+// warnings and only Subnets is used.
+func tunnelSubnets(tunnel TunnelConfig) (string, []string) {
+	tunnel.Subnets = normalizeSubnets(tunnel.Subnets)
+	if tunnel.SubnetsFrom == "" {
+		return tunnel.Subnets, nil
+	}
+
+	data, err := os.ReadFile(expandPath(tunnel.SubnetsFrom))
+	if err != nil {
+		return tunnel.Subnets, []string{fmt.Sprintf("%s: can't read subnets_from file, using subnets only: %v", tunnel.Name, err)}
+	}
+
+	var subnets []string
+	if tunnel.Subnets != "" {
+		subnets = append(subnets, tunnel.Subnets)
+	}
+	var warnings []string
+	for _, line := range strings.Split(string(data), "\n") {
+		// Allow comments in the file
+		line, _, _ = strings.Cut(line, "#")
+		for _, cidr := range strings.Split(line, ",") {
+			cidr = strings.TrimSpace(cidr)
+			if cidr == "" {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				warnings = append(warnings, fmt.Sprintf("%s: ignoring invalid CIDR '%s' in %s", tunnel.Name, cidr, tunnel.SubnetsFrom))
+				continue
+			}
+			subnets = append(subnets, cidr)
+		}
+	}
+	return strings.Join(subnets, ","), warnings
+}
+
+var aliasNameRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// handleGenAliases prints a shell function per configured tunnel plus a
+// vpn_stop function that stops every running tunnel with -stop.
+func handleGenAliases(shell string) error {
+	if shell != "bash" && shell != "fish" {
+		return fmt.Errorf("unsupported shell '%s' (use bash or fish)", shell)
+	}
+
+	config, err := loadOrCreateConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	used := make(map[string]int)
+	for _, tunnel := range expandUsers(config.Tunnels) {
+		command, warnings := buildSshuttleCommand(tunnel)
+		for _, warning := range warnings {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+		}
+
+		if len(tunnel.Env) > 0 {
+			var assignments []string
+			for _, entry := range envAssignments(tunnel.Env) {
+				assignments = append(assignments, shellQuote(entry))
+			}
+			command = "env " + strings.Join(assignments, " ") + " " + command
+		}
+
+		name := "vpn_" + strings.Trim(aliasNameRe.ReplaceAllString(strings.ToLower(tunnel.Name), "_"), "_")
+		used[name]++
+		if used[name] > 1 {
+			name = fmt.Sprintf("%s_%d", name, used[name])
+		}
+
+		printShellFunction(shell, name, "# "+tunnel.Name, command)
+	}
+
+	// -stop finds the tunnels like the list does and can stop sudo ones
+	self, err := os.Executable()
+	if err != nil {
+		self = "sshuttle-selector"
+	}
+	printShellFunction(shell, "vpn_stop", "# Stop all sshuttle tunnels", shellQuote(self)+" -stop")
+
+	return nil
+}
+
+func printShellFunction(shell, name, comment, body string) {
+	fmt.Println(comment)
+	if shell == "fish" {
+		fmt.Printf("function %s\n    %s\nend\n\n", name, body)
+	} else {
+		fmt.Printf("%s() {\n    %s\n}\n\n", name, body)
+	}
+}
+
+// validateProxyCommand checks that a ProxyCommand can be embedded in the
+// single-quoted -o option inside sshuttle's double-quoted --ssh-cmd.
+func validateProxyCommand(proxyCommand string) error {
+	if proxyCommand == "" {
+		return nil
+	}
+	if strings.TrimSpace(proxyCommand) == "" {
+		return fmt.Errorf("proxy command is empty")
+	}
+	if strings.ContainsAny(proxyCommand, "'\"`$\\") {
+		return fmt.Errorf("proxy command must not contain quotes, backticks, $ or backslashes")
+	}
+	return nil
+}
+
+var ssmInstanceRe = regexp.MustCompile(`^m?i-[0-9a-f]+$`)
+
+// tunnelProxyCommand returns the ProxyCommand for tunnel: proxy_command if
+// set, otherwise an AWS SSM session for ssm_instance.
+func tunnelProxyCommand(tunnel TunnelConfig) string {
+	if tunnel.ProxyCommand != "" || tunnel.SSMInstance == "" {
+		return tunnel.ProxyCommand
+	}
+	return fmt.Sprintf("aws ssm start-session --target %s --document-name AWS-StartSSHSession --parameters portNumber=%%p", tunnel.SSMInstance)
+}
+
+// validateSSMInstance checks ssm_instance and that the AWS CLI and its
+// session manager plugin are installed.
+func validateSSMInstance(tunnel TunnelConfig) error {
+	if tunnel.SSMInstance == "" {
+		return nil
+	}
+	if tunnel.ProxyCommand != "" {
+		return fmt.Errorf("ssm_instance and proxy_command can't both be set")
+	}
+	if !ssmInstanceRe.MatchString(tunnel.SSMInstance) {
+		return fmt.Errorf("invalid ssm_instance '%s' (expected an instance ID like i-0123456789abcdef0)", tunnel.SSMInstance)
+	}
+	for _, tool := range []string{"aws", "session-manager-plugin"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("ssm_instance needs %s, which was not found in PATH", tool)
+		}
+	}
+	return nil
+}
+
+// normalizeName returns the form of a tunnel name used for matching:
+// trimmed and lower-cased. The original casing is kept for display.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// configEntry returns the index in config.Tunnels of the entry the listed
+// tunnel name comes from, -1 if there is none. Entries with users are
+// listed once per user as "Name (user)".
+func configEntry(config *Config, name string) int {
+	for idx, tunnel := range config.Tunnels {
+		if normalizeName(tunnel.Name) == normalizeName(name) {
+			return idx
+		}
+		for _, variant := range expandUsers([]TunnelConfig{tunnel}) {
+			if normalizeName(variant.Name) == normalizeName(name) {
+				return idx
+			}
+		}
+	}
+	return -1
+}
+
+// findTunnel returns the configured tunnel with the given name or, failing
+// that, alias, ignoring case and surrounding whitespace.
+func findTunnel(config *Config, name string) (TunnelConfig, bool) {
+	tunnels := expandUsers(config.Tunnels)
+	for _, tunnel := range tunnels {
+		if normalizeName(tunnel.Name) == normalizeName(name) {
+			return tunnel, true
+		}
+	}
+	for _, tunnel := range tunnels {
+		if tunnel.Alias != "" && normalizeName(tunnel.Alias) == normalizeName(name) {
+			return tunnel, true
+		}
+	}
+	return TunnelConfig{}, false
+}
+
+// otherGroup is the group of tunnels that set none.
+const otherGroup = "Other"
+
+// tunnelGroup returns the group tunnel is listed under.
+func tunnelGroup(tunnel TunnelConfig) string {
+	if group := strings.TrimSpace(tunnel.Group); group != "" {
+		return group
+	}
+	return otherGroup
+}
+
+// configGrouped reports whether any of tunnels sets a group. Without
+// groups the TUI shows a single AVAILABLE TUNNELS section.
+func configGrouped(tunnels []TunnelConfig) bool {
+	for _, tunnel := range tunnels {
+		if strings.TrimSpace(tunnel.Group) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnelsInGroup returns the tunnels in group, ignoring case; "other"
+// selects the ungrouped ones.
+func tunnelsInGroup(tunnels []TunnelConfig, group string) []TunnelConfig {
+	var selected []TunnelConfig
+	for _, tunnel := range tunnels {
+		if normalizeName(tunnelGroup(tunnel)) == normalizeName(group) {
+			selected = append(selected, tunnel)
+		}
+	}
+	return selected
+}
+
+// duplicateAliases returns a warning per alias used by more than one
+// tunnel.
+func duplicateAliases(tunnels []TunnelConfig) []string {
+	counts := make(map[string]int)
+	var order []string
+	for _, tunnel := range tunnels {
+		if tunnel.Alias == "" {
+			continue
+		}
+		key := normalizeName(tunnel.Alias)
+		if counts[key] == 0 {
+			order = append(order, tunnel.Alias)
+		}
+		counts[key]++
+	}
+
+	var warnings []string
+	for _, alias := range order {
+		if count := counts[normalizeName(alias)]; count > 1 {
+			warnings = append(warnings, fmt.Sprintf("Duplicate alias '%s' (%d tunnels)", alias, count))
+		}
+	}
+	return warnings
+}
+
+// tunnelPIDs returns the PIDs of running tunnels to destination.
+func tunnelPIDs(destination string) ([]int, error) {
+	tunnels, err := getActiveTunnels()
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, tunnel := range tunnels {
+		if tunnel.Destination == destination {
+			pids = append(pids, tunnel.PID)
+		}
+	}
+	return pids, nil
+}
+
+// startVerifyWait is how long a started tunnel has to show up among the
+// running ones before its start is reported as failed.
+const startVerifyWait = 5 * time.Second
+
+// waitForTunnel waits up to startVerifyWait for a new tunnel to
+// destination, one whose PID is not in existing, to be running and returns
+// its PID, or 0 if none appeared. existing is taken with tunnelPIDs before
+// the start, so an additive tunnel already running to the same destination
+// isn't mistaken for the new one.
+func waitForTunnel(destination string, existing []int) int {
+	started := make(map[int]bool)
+	for _, pid := range existing {
+		started[pid] = true
+	}
+	deadline := time.Now().Add(startVerifyWait)
+	for {
+		pids, _ := tunnelPIDs(destination)
+		for idx := len(pids) - 1; idx >= 0; idx-- {
+			if !started[pids[idx]] {
+				return pids[idx]
+			}
+		}
+		if time.Now().After(deadline) {
+			return 0
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// runningPID returns the PID of a running tunnel to destination, the one
+// listed last if there are several, or 0 if there is none.
+func runningPID(destination string) int {
+	pids, err := tunnelPIDs(destination)
+	if err != nil || len(pids) == 0 {
+		return 0
+	}
+	return pids[len(pids)-1]
+}
+
+// handleSuperviseCommand keeps the named tunnel running, restarting it with
+// exponential backoff whenever it disappears, until interrupted. On
+// interrupt the tunnel is stopped as well.
+func handleSuperviseCommand(name string) error {
+	if name == "" {
+		return fmt.Errorf("tunnel name is required (use -name)")
+	}
+
+	config, err := loadOrCreateConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	tunnel, ok := findTunnel(config, name)
+	if !ok {
+		return fmt.Errorf("no tunnel named '%s'", name)
+	}
+
+	// The supervisor itself stays in the foreground, so the tunnel can be daemonized
+	command, warnings := buildSshuttleCommandWith(tunnel, true)
+	for _, warning := range warnings {
+		log.Printf("Warning: %s", warning)
+	}
+	destination := fmt.Sprintf("%s@%s", tunnel.User, tunnel.Host)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	backoff := superviseMinBackoff
+	ticker := time.NewTicker(superviseInterval)
+	defer ticker.Stop()
+
+	start := func() {
+		log.Printf("Starting %s (%s)", tunnel.Name, destination)
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = tunnelEnv(tunnel.Env)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		if err != nil {
+			log.Printf("Failed to start %s: %v", tunnel.Name, err)
+		}
+		logActivity("start", tunnel.Name, destination, runningPID(destination), exitStatus(err))
+	}
+
+	if pids, err := tunnelPIDs(destination); err == nil && len(pids) > 0 {
+		log.Printf("%s is already running (PID: %d), supervising it", tunnel.Name, pids[0])
+	} else {
+		start()
+	}
+
+	for {
+		select {
+		case <-signals:
+			log.Printf("Stopping supervision of %s", tunnel.Name)
+			pids, err := tunnelPIDs(destination)
+			if err != nil {
+				return err
+			}
+			for _, pid := range pids {
+				if err := killTunnel(pid, tunnel.Name, destination); err != nil {
+					log.Printf("Failed to kill tunnel %d: %v", pid, err)
+				}
+			}
+			return nil
+
+		case <-ticker.C:
+			pids, err := tunnelPIDs(destination)
+			if err != nil {
+				log.Printf("Warning: Failed to check tunnels: %v", err)
+				continue
+			}
+			if len(pids) > 0 {
+				backoff = superviseMinBackoff
+				continue
+			}
+
+			log.Printf("%s dropped, reconnecting in %s", tunnel.Name, backoff)
+			logActivity("dropped", tunnel.Name, destination, 0, "")
+			select {
+			case <-time.After(backoff):
+			case sig := <-signals:
+				// Let the outer loop handle the shutdown
+				signals <- sig
+				continue
+			}
+			start()
+
+			backoff *= 2
+			if backoff > superviseMaxBackoff {
+				backoff = superviseMaxBackoff
+			}
+		}
+	}
+}
+
+// unitName derives a systemd/launchd friendly identifier from a tunnel name.
+func unitName(name string) string {
+	return "sshuttle-" + strings.Trim(aliasNameRe.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// systemdQuote quotes s as a single systemd command line argument.
+func systemdQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(s)
+	return `"` + s + `"`
+}
+
+// handleGenSystemd prints a systemd user unit running the named tunnel in
+// the foreground, so systemd can track and restart it.
+func handleGenSystemd(name string) error {
+	if name == "" {
+		return fmt.Errorf("tunnel name is required (use -name)")
+	}
+
+	config, err := loadOrCreateConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	tunnel, ok := findTunnel(config, name)
+	if !ok {
+		return fmt.Errorf("no tunnel named '%s'", name)
+	}
+
+	command, warnings := buildSshuttleCommandWith(tunnel, false)
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	unit := unitName(tunnel.Name)
+
+	fmt.Printf("# Save as ~/.config/systemd/user/%s.service, then run:\n", unit)
+	fmt.Printf("#   systemctl --user daemon-reload && systemctl --user enable --now %s\n", unit)
+	fmt.Println("# sshuttle uses sudo for its firewall rules, which must not prompt for a password.")
+	fmt.Println("[Unit]")
+	fmt.Printf("Description=sshuttle tunnel %s (%s@%s)\n", tunnel.Name, tunnel.User, tunnel.Host)
+	fmt.Println("Wants=network-online.target")
+	fmt.Println("After=network-online.target")
+	fmt.Println()
+	fmt.Println("[Service]")
+	fmt.Println("Type=simple")
+	for _, assignment := range envAssignments(tunnel.Env) {
+		fmt.Printf("Environment=%s\n", systemdQuote(assignment))
+	}
+	fmt.Printf("ExecStart=/bin/sh -c %s\n", systemdQuote("exec "+command))
+	fmt.Println("ExecStop=/bin/kill -TERM $MAINPID")
+	fmt.Println("Restart=on-failure")
+	fmt.Println("RestartSec=5")
+	fmt.Println()
+	fmt.Println("[Install]")
+	fmt.Println("WantedBy=default.target")
+
+	return nil
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// handleGenLaunchd prints a launchd agent plist running the named tunnel in
+// the foreground and keeping it alive.
+func handleGenLaunchd(name string) error {
+	if name == "" {
+		return fmt.Errorf("tunnel name is required (use -name)")
+	}
+
+	config, err := loadOrCreateConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	tunnel, ok := findTunnel(config, name)
+	if !ok {
+		return fmt.Errorf("no tunnel named '%s'", name)
+	}
+
+	command, warnings := buildSshuttleCommandWith(tunnel, false)
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	label := "io.github.tgigli." + unitName(tunnel.Name)
+
+	// launchd agents get a minimal PATH, which misses Homebrew's sshuttle
+	env := map[string]string{"PATH": os.Getenv("PATH")}
+	for key, value := range tunnel.Env {
+		env[key] = value
+	}
+
+	fmt.Println(`<?xml version="1.0" encoding="UTF-8"?>`)
+	fmt.Println(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">`)
+	fmt.Printf("<!-- Save as ~/Library/LaunchAgents/%s.plist, then run:\n", label)
+	fmt.Printf("     launchctl load -w ~/Library/LaunchAgents/%s.plist\n", label)
+	fmt.Println("     sshuttle uses sudo for its firewall rules, which must not prompt for a password. -->")
+	fmt.Println(`<plist version="1.0">`)
+	fmt.Println("<dict>")
+	fmt.Printf("  <key>Label</key>\n  <string>%s</string>\n", xmlEscape(label))
+	fmt.Println("  <key>ProgramArguments</key>")
+	fmt.Println("  <array>")
+	for _, arg := range []string{"/bin/sh", "-c", "exec " + command} {
+		fmt.Printf("    <string>%s</string>\n", xmlEscape(arg))
+	}
+	fmt.Println("  </array>")
+	fmt.Println("  <key>EnvironmentVariables</key>")
+	fmt.Println("  <dict>")
+	for _, assignment := range envAssignments(env) {
+		key, value, _ := strings.Cut(assignment, "=")
+		fmt.Printf("    <key>%s</key>\n    <string>%s</string>\n", xmlEscape(key), xmlEscape(value))
+	}
+	fmt.Println("  </dict>")
+	fmt.Println("  <key>RunAtLoad</key>\n  <true/>")
+	fmt.Println("  <key>KeepAlive</key>\n  <true/>")
+	fmt.Printf("  <key>StandardOutPath</key>\n  <string>/tmp/%s.log</string>\n", xmlEscape(label))
+	fmt.Printf("  <key>StandardErrorPath</key>\n  <string>/tmp/%s.log</string>\n", xmlEscape(label))
+	fmt.Println("</dict>")
+	fmt.Println("</plist>")
+
+	return nil
+}
+
+// handleTestAllCommand checks SSH connectivity to every configured tunnel
+// in parallel and prints a summary table. It fails if any check fails.
+func handleTestAllCommand() error {
+	config, err := loadOrCreateConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	tunnels := expandUsers(config.Tunnels)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testAllTimeout)
+	defer cancel()
+
+	results := make([]error, len(tunnels))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < testAllWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				results[idx] = validateSSHConnectionContext(ctx, tunnels[idx])
+				// A test that finished just before the deadline keeps its result
+				if results[idx] != nil && ctx.Err() != nil {
+					results[idx] = fmt.Errorf("timed out")
+				}
+			}
+		}()
+	}
+	for idx := range tunnels {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+
+	summary := make([]batchResult, len(tunnels))
+	for idx, tunnel := range tunnels {
+		summary[idx] = batchResult{tunnel.Name, "ok", tunnel.User + "@" + tunnel.Host}
+		if results[idx] != nil {
+			summary[idx] = batchResult{tunnel.Name, "failed", fmt.Sprintf("%s: %v", tunnel.User+"@"+tunnel.Host, results[idx])}
+		}
+	}
+
+	if failed := printBatchSummary(summary)["failed"]; failed > 0 {
+		return fmt.Errorf("%d of %d tunnels unreachable", failed, len(tunnels))
+	}
+	return nil
+}
+
+// batchResult is the outcome of one tunnel in a command that acts on
+// several, such as "started", "skipped" or "failed".
+type batchResult struct {
+	name    string
+	outcome string
+	detail  string
+}
+
+// printBatchSummary prints results as an aligned table followed by a count
+// per outcome, and returns the counts.
+func printBatchSummary(results []batchResult) map[string]int {
+	rows := [][]string{{"TUNNEL", "RESULT", "DETAIL"}}
+	counts := make(map[string]int)
+	var outcomes []string
+	for _, result := range results {
+		rows = append(rows, []string{result.name, result.outcome, result.detail})
+		if counts[result.outcome] == 0 {
+			outcomes = append(outcomes, result.outcome)
+		}
+		counts[result.outcome]++
+	}
+	printTable(rows)
+
+	var tally []string
+	for _, outcome := range outcomes {
+		tally = append(tally, fmt.Sprintf("%d %s", counts[outcome], outcome))
+	}
+	fmt.Printf("\n%s\n", strings.Join(tally, ", "))
+	return counts
+}
+
+// handleAutoConnectCommand starts every tunnel marked auto_connect as a
+// daemon. Tunnels that are already running, need interactive
+// authentication, or overlap the subnets of a running tunnel are skipped.
+// Per-tunnel post_connect commands are not run, as nobody may be watching.
+func handleAutoConnectCommand() error {
+	config, err := loadOrCreateConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	activeTunnels, err := getActiveTunnels()
+	if err != nil {
+		return fmt.Errorf("failed to list tunnels: %v", err)
+	}
+
+	// Subnets already routed, with who routes them
+	type claim struct{ owner, subnets string }
+	var claimed []claim
+	activeDestinations := make(map[string]bool)
+	for _, tunnel := range activeTunnels {
+		activeDestinations[tunnel.Destination] = true
+		claimed = append(claimed, claim{tunnel.Destination, strings.Join(tunnel.Args.Subnets, ",")})
+	}
+
+	var results []batchResult
+	for _, tunnel := range expandUsers(config.Tunnels) {
+		if !tunnel.AutoConnect {
+			continue
+		}
+		destination := fmt.Sprintf("%s@%s", tunnel.User, tunnel.Host)
+
+		if activeDestinations[destination] {
+			results = append(results, batchResult{tunnel.Name, "skipped", "already connected"})
+			continue
+		}
+		if tunnel.Interactive {
+			results = append(results, batchResult{tunnel.Name, "skipped", "needs interactive authentication"})
+			continue
+		}
+		subnets, _ := tunnelSubnets(tunnel)
+		overlapping := ""
+		for _, c := range claimed {
+			if subnetsOverlap(subnets, c.subnets) {
+				overlapping = c.owner
+				break
+			}
+		}
+		if overlapping != "" {
+			results = append(results, batchResult{tunnel.Name, "skipped", "subnets overlap with " + overlapping})
+			continue
+		}
+		if err := checkListenAvailable(tunnel.Listen); err != nil {
+			results = append(results, batchResult{tunnel.Name, "failed", err.Error()})
+			continue
+		}
+
+		command, warnings := buildSshuttleCommandWith(tunnel, true)
+		for _, warning := range warnings {
+			fmt.Printf("Warning: %s\n", warning)
+		}
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = tunnelEnv(tunnel.Env)
+		var stderr tailBuffer
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+		if err := cmd.Run(); err != nil {
+			detail := err.Error()
+			if hint := sshuttleErrorHint(stderr.String()); hint != "" {
+				detail += ". " + hint
+			}
+			results = append(results, batchResult{tunnel.Name, "failed", detail})
+			continue
+		}
+
+		results = append(results, batchResult{tunnel.Name, "started", destination})
+		activeDestinations[destination] = true
+		claimed = append(claimed, claim{tunnel.Name, subnets})
+		recordDestinations(destination)
+		runPostConnect(config.PostConnect, item{destination: destination, tunnel: tunnel})
+	}
+
+	if len(results) == 0 {
+		fmt.Println("No tunnels are marked auto_connect.")
+		return nil
+	}
+	fmt.Println()
+	if failed := printBatchSummary(results)["failed"]; failed > 0 {
+		return fmt.Errorf("%d of %d tunnels failed to start", failed, len(results))
+	}
+	return nil
+}
+
+// handleCheckUpdatesCommand fetches the latest version from update_url and
+// says whether it is newer than this build. Network problems are reported
+// but not treated as errors.
+func handleCheckUpdatesCommand() error {
+	config, err := loadOrCreateConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if config.UpdateURL == "" {
+		return fmt.Errorf("no update_url configured")
+	}
+
+	client := http.Client{Timeout: updateCheckTimeout}
+	resp, err := client.Get(config.UpdateURL)
+	if err != nil {
+		fmt.Printf("Warning: couldn't check for updates: %v\n", err)
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Warning: couldn't check for updates: %s returned %s\n", config.UpdateURL, resp.Status)
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		fmt.Printf("Warning: couldn't check for updates: %v\n", err)
+		return nil
+	}
+	latest := strings.TrimSpace(string(body))
+
+	switch {
+	case version == "dev":
+		fmt.Printf("Latest version is %s (this is a development build)\n", latest)
+	case compareVersions(latest, version) > 0:
+		fmt.Printf("Update available: %s (installed: %s)\n", latest, version)
+	default:
+		fmt.Printf("Up to date (%s)\n", version)
+	}
+	return nil
+}
+
+// compareVersions compares dotted versions such as v1.2.3 numerically,
+// ignoring a leading v and any -suffix. It returns -1, 0 or 1.
+func compareVersions(a, b string) int {
+	parts := func(v string) []int {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+		v, _, _ = strings.Cut(v, "-")
+		var nums []int
+		for _, field := range strings.Split(v, ".") {
+			n, _ := strconv.Atoi(field)
+			nums = append(nums, n)
+		}
+		return nums
+	}
+
+	pa, pb := parts(a), parts(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// handleListCommand prints the configured tunnels, either as a table or by
+// executing format as a Go template against each TunnelConfig.
+func handleListCommand(format, group string, asJSON bool) error {
+	if format == "json" {
+		// Same as -json
+		format, asJSON = "", true
+	}
+	if asJSON && format != "" {
+		return fmt.Errorf("-json and -format can't be combined")
+	}
+
+	var tmpl *template.Template
+	if format != "" && format != "table" {
+		var err error
+		tmpl, err = template.New("format").Parse(format)
+		if err != nil {
+			return fmt.Errorf("invalid -format template: %v", err)
+		}
+	}
+
+	config, err := loadOrCreateConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if group != "" {
+		config.Tunnels = tunnelsInGroup(config.Tunnels, group)
+	}
+
+	if tmpl == nil {
+		// Mark running tunnels; listing processes failing just leaves
+		// them unmarked
+		running := make(map[string]int)
+		if tunnels, err := getActiveTunnels(); err == nil {
+			for _, tunnel := range tunnels {
+				if running[tunnel.Destination] == 0 {
+					running[tunnel.Destination] = tunnel.PID
+				}
+			}
+		}
+
+		if asJSON {
+			list := ListJSON{Version: jsonSchemaVersion, Tunnels: []TunnelJSON{}}
+			for _, tunnel := range expandUsers(config.Tunnels) {
+				destination := tunnel.User + "@" + tunnel.Host
+				subnets, _ := tunnelSubnets(tunnel)
+				list.Tunnels = append(list.Tunnels, TunnelJSON{
+					Name:        tunnel.Name,
+					Host:        tunnel.Host,
+					User:        tunnel.User,
+					Destination: destination,
+					Subnets:     splitSubnets(subnets),
+					ExtraArgs:   tunnel.ExtraArgs.String(),
+					Interactive: tunnel.Interactive,
+					AutoConnect: tunnel.AutoConnect,
+					Running:     running[destination] != 0,
+					PID:         running[destination],
+					Group:       tunnel.Group,
+				})
+			}
+			return printJSON(list)
+		}
+
+		// The group column is only shown once a tunnel has a group
+		grouped := configGrouped(config.Tunnels)
+		rows := [][]string{{"", "NAME", "DESTINATION", "SUBNETS"}}
+		if grouped {
+			rows[0] = append(rows[0], "GROUP")
+		}
+		for _, tunnel := range expandUsers(config.Tunnels) {
+			destination := tunnel.User + "@" + tunnel.Host
+			marker := ""
+			if running[destination] != 0 {
+				marker = "●"
+			}
+			row := []string{marker, tunnel.Name, destination, tunnel.Subnets}
+			if grouped {
+				row = append(row, tunnelGroup(tunnel))
+			}
+			rows = append(rows, row)
+		}
+		printTable(rows)
+		return nil
+	}
+
+	for _, tunnel := range expandUsers(config.Tunnels) {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, tunnel); err != nil {
+			return fmt.Errorf("failed to render -format template for '%s': %v", tunnel.Name, err)
+		}
+		if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+		os.Stdout.Write(buf.Bytes())
+	}
+
+	return nil
+}
+
+// printTable prints rows with each column padded to its widest value. When
+// stdout is a terminal, lines wider than it are cut off with an ellipsis.
+func printTable(rows [][]string) {
+	var widths []int
+	for _, row := range rows {
+		for col, cell := range row {
+			if col == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[col] = max(widths[col], lipgloss.Width(cell))
+		}
+	}
+
+	maxWidth := 0
+	if term.IsTerminal(os.Stdout.Fd()) {
+		if width, _, err := term.GetSize(os.Stdout.Fd()); err == nil {
+			maxWidth = width
+		}
+	}
+
+	for _, row := range rows {
+		var line strings.Builder
+		for col, cell := range row {
+			line.WriteString(cell)
+			// The last column isn't padded to avoid trailing spaces
+			if col < len(row)-1 {
+				line.WriteString(strings.Repeat(" ", widths[col]-lipgloss.Width(cell)+1))
+			}
+		}
+		text := line.String()
+		if maxWidth > 0 {
+			text = ansi.Truncate(text, maxWidth, "…")
+		}
+		fmt.Println(text)
+	}
+}
+
+func handleAddCommand(newTunnel TunnelConfig) error {
+	newTunnel, notes, warnings, err := prepareNewTunnel(newTunnel)
+	if err != nil {
+		return err
+	}
+	for _, note := range notes {
+		fmt.Println(note)
+	}
+	for _, warning := range warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+
+	// Validate SSH connectivity (optional test)
+	if err := validateSSHConnection(newTunnel); err != nil {
+		fmt.Printf("Warning: SSH connectivity test failed: %v\n", err)
+		fmt.Print("Continue anyway? [y/N]: ")
+		var response string
+		fmt.Scanln(&response)
+		if strings.ToLower(response) != "y" && strings.ToLower(response) != "yes" {
+			return fmt.Errorf("operation cancelled")
+		}
+	}
+
+	return addTunnelToConfig(newTunnel)
+}
+
+// prepareNewTunnel validates a tunnel about to be added by -add or the add
+// form and fills in default subnets. It returns the tunnel to save, notes
+// on the defaults used and warnings that don't prevent saving it.
+func prepareNewTunnel(newTunnel TunnelConfig) (TunnelConfig, []string, []string, error) {
+	if configReadOnly() {
+		return newTunnel, nil, nil, errConfigReadOnly
+	}
+	var notes, warnings []string
+
 	// Validate required parameters
-	if name == "" {
-		return fmt.Errorf("tunnel name is required (use -name)")
+	newTunnel.Name = strings.TrimSpace(newTunnel.Name)
+	if newTunnel.Name == "" {
+		return newTunnel, nil, nil, fmt.Errorf("tunnel name is required (use -name)")
+	}
+	newTunnel.User = strings.TrimSpace(newTunnel.User)
+	newTunnel.Host = strings.TrimSpace(newTunnel.Host)
+	if newTunnel.Host == "" {
+		return newTunnel, nil, nil, fmt.Errorf("SSH hostname is required (use -host)")
+	}
+	if newTunnel.User == "" {
+		return newTunnel, nil, nil, fmt.Errorf("SSH username is required (use -user)")
+	}
+	if err := validateUserHost(newTunnel.User, newTunnel.Host); err != nil {
+		return newTunnel, nil, nil, err
+	}
+	if newTunnel.Subnets == "" && newTunnel.SubnetsFrom == "" {
+		// Fall back to a subnet template matching the host, then to
+		// default_subnets
+		config, err := loadOrCreateConfig()
+		if err != nil {
+			config = &Config{}
+		}
+		if newTunnel.Subnets = subnetTemplateFor(config, newTunnel.Host); newTunnel.Subnets != "" {
+			notes = append(notes, fmt.Sprintf("Using subnets %s from template for %s", newTunnel.Subnets, newTunnel.Host))
+		} else if config.DefaultSubnets != "" {
+			if err := validateSubnets(config.DefaultSubnets); err != nil {
+				return newTunnel, nil, nil, fmt.Errorf("invalid default_subnets: %v", err)
+			}
+			newTunnel.Subnets = config.DefaultSubnets
+			notes = append(notes, fmt.Sprintf("Using default subnets %s", newTunnel.Subnets))
+		} else {
+			return newTunnel, nil, nil, fmt.Errorf("subnets are required (use -subnets, or set default_subnets in the config)")
+		}
+	}
+
+	// Validate subnet format, saving shorthand as full CIDRs
+	if newTunnel.Subnets != "" {
+		if err := validateSubnets(newTunnel.Subnets); err != nil {
+			return newTunnel, nil, nil, fmt.Errorf("invalid subnet format: %v", err)
+		}
+		newTunnel.Subnets = normalizeSubnets(newTunnel.Subnets)
+	}
+
+	// The subnets file may be synced later, so only warn
+	if newTunnel.SubnetsFrom != "" {
+		_, subnetWarnings := tunnelSubnets(newTunnel)
+		warnings = append(warnings, subnetWarnings...)
+	}
+
+	if err := validateProxyCommand(newTunnel.ProxyCommand); err != nil {
+		return newTunnel, nil, nil, fmt.Errorf("invalid proxy command: %v", err)
+	}
+	if err := validateSSMInstance(newTunnel); err != nil {
+		return newTunnel, nil, nil, err
+	}
+	if err := validateMethod(newTunnel.Method); err != nil {
+		return newTunnel, nil, nil, err
+	}
+	if newTunnel.Exclude != "" {
+		if err := validateSubnets(newTunnel.Exclude); err != nil {
+			return newTunnel, nil, nil, fmt.Errorf("invalid exclude: %v", err)
+		}
+		newTunnel.Exclude = normalizeSubnets(newTunnel.Exclude)
+	}
+	if newTunnel.NSHosts != "" {
+		if err := validateNSHosts(newTunnel.NSHosts); err != nil {
+			return newTunnel, nil, nil, fmt.Errorf("invalid ns-hosts: %v", err)
+		}
+		newTunnel.NSHosts = strings.Join(subnetFields(newTunnel.NSHosts), ",")
+	}
+
+	warnings = append(warnings, hostRoutedWarnings(newTunnel.Host, newTunnel.Subnets)...)
+
+	// The exclusion file may be synced later, so only warn
+	if newTunnel.ExcludeFrom != "" {
+		if _, err := os.Stat(expandPath(newTunnel.ExcludeFrom)); err != nil {
+			warnings = append(warnings, "exclude-from file not found: "+newTunnel.ExcludeFrom)
+		}
+	}
+
+	return newTunnel, notes, warnings, nil
+}
+
+// addTunnelToConfig appends newTunnel to the saved config, rejecting
+// names that match an existing one ignoring case and whitespace.
+func addTunnelToConfig(newTunnel TunnelConfig) error {
+	newTunnel.Name = strings.TrimSpace(newTunnel.Name)
+	return updateConfig(func(config *Config) error {
+		// Check for duplicate names
+		if existing, ok := findTunnel(config, newTunnel.Name); ok {
+			return fmt.Errorf("tunnel with name '%s' already exists", existing.Name)
+		}
+
+		// Add new tunnel
+		config.Tunnels = append(config.Tunnels, newTunnel)
+		return nil
+	})
+}
+
+// handleTidyCommand removes exact duplicate tunnels from the config and
+// sorts the rest by group, if any, and name, keeping a backup of the
+// previous file. A tidy config is left untouched.
+func handleTidyCommand() error {
+	var changes []string
+	err := updateConfig(func(config *Config) error {
+		seen := make(map[string]bool)
+		var tunnels []TunnelConfig
+		for _, tunnel := range config.Tunnels {
+			key, err := yaml.Marshal(tunnel)
+			if err != nil {
+				return err
+			}
+			if seen[string(key)] {
+				changes = append(changes, fmt.Sprintf("removed duplicate of '%s'", tunnel.Name))
+				continue
+			}
+			seen[string(key)] = true
+			tunnels = append(tunnels, tunnel)
+		}
+
+		// Grouped configs are sorted the way the list shows them
+		grouped := configGrouped(tunnels)
+		less := func(a, b int) bool {
+			if grouped {
+				ga, gb := normalizeName(tunnelGroup(tunnels[a])), normalizeName(tunnelGroup(tunnels[b]))
+				if ga != gb {
+					other := normalizeName(otherGroup)
+					if (ga == other) != (gb == other) {
+						return gb == other
+					}
+					return ga < gb
+				}
+			}
+			return normalizeName(tunnels[a].Name) < normalizeName(tunnels[b].Name)
+		}
+		if !sort.SliceIsSorted(tunnels, less) {
+			sort.SliceStable(tunnels, less)
+			if grouped {
+				changes = append(changes, "sorted tunnels by group and name")
+			} else {
+				changes = append(changes, "sorted tunnels by name")
+			}
+		}
+
+		// Same name but different settings needs a human decision
+		for i := 1; i < len(tunnels); i++ {
+			if normalizeName(tunnels[i].Name) == normalizeName(tunnels[i-1].Name) {
+				fmt.Printf("Warning: '%s' and '%s' differ but share a name, keeping both\n", tunnels[i-1].Name, tunnels[i].Name)
+			}
+		}
+
+		if len(changes) == 0 {
+			return errConfigUnchanged
+		}
+		config.Tunnels = tunnels
+		return backupConfig()
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(changes) == 0 {
+		fmt.Println("Config is already tidy.")
+		return nil
+	}
+	for _, change := range changes {
+		fmt.Printf("- %s\n", change)
+	}
+	return nil
+}
+
+// configTemplate is written by -init. It must stay valid YAML that passes
+// -validate.
+const configTemplate = `# sshuttle-selector configuration
+# Check it with: sshuttle-selector -validate
+
+# ssh host key checking for every tunnel: no, accept-new (trust on first
+# use, refuse changed keys) or yes (known_hosts only)
+host_key_checking: "accept-new"
+
+# Ask before quitting while tunnels are running
+# confirm_quit_with_active: true
+
+# Shell command run after any tunnel starts, with SSHUTTLE_SELECTOR_TUNNEL
+# and SSHUTTLE_SELECTOR_DESTINATION set
+# post_connect: "notify-send \"Tunnel up: $SSHUTTLE_SELECTOR_TUNNEL\""
+
+# Terminal used by -new-window; the command is passed as its last argument
+# terminal_cmd: "alacritty -e sh -c"
+
+# Subnets suggested by -add when the host matches a glob
+# subnet_templates:
+#   "*.corp.example.com": "10.0.0.0/8"
+
+# Rebind TUI keys, comma-separated per action
+# keybindings:
+#   kill-all: "X"
+
+tunnels:
+  - name: "Example Server"        # shown in the list, used by -name
+    host: "server.example.com"    # ssh host, optionally host:port
+    user: "ubuntu"                # ssh user
+    # users: ["deploy", "readonly"] # one entry per user instead of user
+
+    # Comma-separated CIDRs to route; shorthand such as 10. or a bare IP
+    # works, 0.0.0.0/0 routes everything
+    subnets: "10.0.0.0/8"
+    # subnets_from: "~/corp-subnets.txt"  # more CIDRs, one per line
+    # exclude: "10.0.5.0/24"              # CIDRs never routed
+    # exclude_from: "~/corp-excludes.txt" # more of them, one per line
+
+    # Tunnel DNS requests too, optionally to specific name servers
+    # dns: true
+    # ns_hosts: "10.0.0.2"
+
+    # Extra sshuttle arguments, e.g. an ssh key
+    # extra_args: "-i ~/.ssh/example.pem"
+
+    # sshuttle long options as a map, rendered as --key=value
+    # options:
+    #   latency-buffer-size: "8192"
+
+    # ssh options, rendered as -o Key=value
+    # ssh_options:
+    #   ServerAliveInterval: "30"
+
+    # Reach the host through a proxy or an AWS SSM session
+    # proxy_command: "nc -X 5 -x proxy.example.com:1080 %h %p"
+    # ssm_instance: "i-0123456789abcdef0"
+
+    # Environment variables for sshuttle
+    # env:
+    #   SSH_AUTH_SOCK: "/run/user/1000/ssh-agent.socket"
+
+    # alias: "ex"             # short code for -name and quick jumps
+    # method: "tproxy"         # sshuttle firewall method
+    # family: "4"              # 4 or 6 to route one address family only
+    # connect_timeout: 10      # seconds, for connectivity checks
+    # host_key_checking: "no"  # overrides the top-level setting
+    # interactive: true        # run in the foreground for 2FA prompts
+    # auto_connect: true       # start with -autoconnect
+    # listen: "0.0.0.0:12300"  # sshuttle --listen
+
+    # Confirm the network after connecting by reverse-resolving an address
+    # inside the subnets
+    # probe_address: "10.0.0.53"
+    # probe_expect: "corp.internal"
+
+    # Run in the foreground once this tunnel is up
+    # post_connect: "psql -h db.corp.internal"
+`
+
+// handleInitCommand writes configTemplate to the config path. An existing
+// config is only replaced with force, after backing it up.
+func handleInitCommand(force bool) error {
+	configPath, err := configPath()
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(configPath); err == nil {
+		if !force {
+			return fmt.Errorf("%s already exists, use -force to replace it", configPath)
+		}
+		if err := backupConfig(); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(configPath, []byte(configTemplate), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s, edit it to add your tunnels\n", configPath)
+	return nil
+}
+
+// handleMergeCommand adds the tunnels of another config file to ours.
+// Tunnels whose name is taken are skipped, renamed to "Name (2)" or
+// overwrite ours, depending on onConflict; identical ones are left alone.
+func handleMergeCommand(path, onConflict string) error {
+	if onConflict != "skip" && onConflict != "rename" && onConflict != "overwrite" {
+		return fmt.Errorf("invalid -on-conflict '%s' (want skip, rename or overwrite)", onConflict)
+	}
+
+	data, err := os.ReadFile(expandPath(path))
+	if err != nil {
+		return configIOError(path, err)
+	}
+	var other Config
+	if err := yaml.Unmarshal(data, &other); err != nil {
+		return configParseError(path, err)
+	}
+
+	var added, unchanged, skipped, renamed, overwritten []string
+	err = updateConfig(func(config *Config) error {
+		index := make(map[string]int)
+		for i, tunnel := range config.Tunnels {
+			index[normalizeName(tunnel.Name)] = i
+		}
+
+		for _, tunnel := range trimTunnels(other.Tunnels) {
+			i, taken := index[normalizeName(tunnel.Name)]
+			if !taken {
+				index[normalizeName(tunnel.Name)] = len(config.Tunnels)
+				config.Tunnels = append(config.Tunnels, tunnel)
+				added = append(added, tunnel.Name)
+				continue
+			}
+
+			ours, _ := yaml.Marshal(config.Tunnels[i])
+			theirs, _ := yaml.Marshal(tunnel)
+			if bytes.Equal(ours, theirs) {
+				unchanged = append(unchanged, tunnel.Name)
+				continue
+			}
+
+			switch onConflict {
+			case "skip":
+				skipped = append(skipped, tunnel.Name)
+			case "overwrite":
+				config.Tunnels[i] = tunnel
+				overwritten = append(overwritten, tunnel.Name)
+			case "rename":
+				name := tunnel.Name
+				for n := 2; ; n++ {
+					name = fmt.Sprintf("%s (%d)", tunnel.Name, n)
+					if _, taken := index[normalizeName(name)]; !taken {
+						break
+					}
+				}
+				renamed = append(renamed, fmt.Sprintf("%s -> %s", tunnel.Name, name))
+				tunnel.Name = name
+				index[normalizeName(name)] = len(config.Tunnels)
+				config.Tunnels = append(config.Tunnels, tunnel)
+			}
+		}
+
+		if len(added)+len(renamed)+len(overwritten) == 0 {
+			return nil
+		}
+		// A first config has nothing to back up
+		if configPath, err := configPath(); err == nil {
+			if _, err := os.Stat(configPath); err != nil {
+				return nil
+			}
+		}
+		return backupConfig()
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, group := range []struct {
+		label string
+		names []string
+	}{
+		{"Added", added},
+		{"Renamed", renamed},
+		{"Overwritten", overwritten},
+		{"Skipped (name taken)", skipped},
+		{"Already present", unchanged},
+	} {
+		if len(group.names) > 0 {
+			fmt.Printf("%s: %s\n", group.label, strings.Join(group.names, ", "))
+		}
+	}
+	fmt.Printf("%d added, %d renamed, %d overwritten, %d skipped, %d already present\n",
+		len(added), len(renamed), len(overwritten), len(skipped), len(unchanged))
+	return nil
+}
+
+// backupConfig copies the config file to a .bak file next to it.
+func backupConfig() error {
+	configPath, err := configPath()
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to back up config: %v", err)
+	}
+	if err := os.WriteFile(configPath+".bak", data, 0644); err != nil {
+		return fmt.Errorf("failed to back up config: %v", err)
+	}
+	fmt.Printf("Previous config saved to %s.bak\n", configPath)
+	return nil
+}
+
+// updateConfig loads the config, applies fn and saves the result while
+// holding the config lock, so concurrent instances can't lose each
+// other's changes. Nothing is saved if fn returns an error, and
+// errConfigUnchanged skips the save without failing.
+func updateConfig(fn func(*Config) error) error {
+	if configReadOnly() {
+		return errConfigReadOnly
+	}
+
+	unlock, err := lockConfig()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Load existing config or create new one
+	config, err := loadOrCreateConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	if err := fn(config); err == errConfigUnchanged {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Save config
+	if err := saveConfig(config); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+
+	return nil
+}
+
+// configReadOnly reports whether the config must not be modified, either
+// because of -readonly or because the file isn't writable for this user.
+func configReadOnly() bool {
+	if readOnlyMode {
+		return true
+	}
+
+	configPath, err := configPath()
+	if err != nil {
+		return false
+	}
+	f, err := os.OpenFile(configPath, os.O_WRONLY, 0)
+	if err != nil {
+		return os.IsPermission(err)
+	}
+	f.Close()
+	return false
+}
+
+// lockConfig takes an exclusive lock on the config by creating a lock file
+// next to it, waiting up to configLockTimeout for other holders. Lock files
+// older than configLockStale are assumed to belong to a crashed process.
+func lockConfig() (func(), error) {
+	configPath, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+
+	lockPath := configPath + ".lock"
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0755); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(configLockTimeout)
+	for {
+		lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintf(lockFile, "%d\n", os.Getpid())
+			lockFile.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > configLockStale {
+			os.Remove(lockPath)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for config lock %s (another instance is saving; remove the file if it is stale)", lockPath)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// splitArgs splits a command line into arguments the way a POSIX shell
+// would, honoring single quotes, double quotes and backslash escapes.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else if r == '\\' && i+1 < len(runes) && strings.ContainsRune(`"\\$`+"`", runes[i+1]) {
+				i++
+				current.WriteRune(runes[i])
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == '\\':
+			if i+1 < len(runes) {
+				i++
+				current.WriteRune(runes[i])
+			}
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// sshuttle options that consume the following argument
+var sshuttleValueOptions = map[string]bool{
+	"-x": true, "--exclude": true, "-X": true, "--exclude-from": true,
+	"-l": true, "--listen": true, "--ns-hosts": true, "--to-ns": true,
+	"--method": true, "--python": true, "--pidfile": true, "--user": true,
+}
+
+// sshOnlyOptions are ssh options taking a value that sshuttle doesn't have,
+// used to find the end of an unquoted --ssh-cmd.
+var sshOnlyOptions = map[string]bool{
+	"-o": true, "-i": true, "-p": true, "-F": true, "-J": true,
+}
+
+// hostKeyCheckingValues are the accepted host_key_checking values. ask is
+// left out as the ssh run by sshuttle can't prompt.
+var hostKeyCheckingValues = map[string]bool{"no": true, "accept-new": true, "yes": true}
+
+func setHostKeyChecking(config *Config) {
+	hostKeyChecking = config.HostKeyChecking
+	if hostKeyChecking == "" {
+		hostKeyChecking = "no"
+	}
+}
+
+// tunnelHostKeyChecking returns the StrictHostKeyChecking value for tunnel,
+// falling back to no for invalid values, see validateHostKeyChecking.
+func tunnelHostKeyChecking(tunnel TunnelConfig) string {
+	value := tunnel.HostKeyChecking
+	if value == "" {
+		value = hostKeyChecking
+	}
+	if !hostKeyCheckingValues[value] {
+		return "no"
+	}
+	return value
+}
+
+func validateHostKeyChecking(tunnel TunnelConfig) error {
+	value := tunnel.HostKeyChecking
+	if value == "" {
+		value = hostKeyChecking
+	}
+	if !hostKeyCheckingValues[value] {
+		return fmt.Errorf("invalid host_key_checking '%s' (want no, accept-new or yes), using no", value)
+	}
+	return nil
+}
+
+var sshOptionNameRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+
+// sshOptionPairs renders an ssh_options map as sorted Key=value pairs for
+// ssh -o, skipping (and reporting) options whose name doesn't look like an
+// ssh option or whose value can't be embedded in --ssh-cmd.
+func sshOptionPairs(options map[string]string) ([]string, error) {
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	var invalid []string
+	for _, key := range keys {
+		value := options[key]
+		if !sshOptionNameRe.MatchString(key) || strings.ContainsAny(value, "'\"`$\\") {
+			invalid = append(invalid, key)
+			continue
+		}
+		pairs = append(pairs, key+"="+value)
+	}
+
+	if len(invalid) > 0 {
+		return pairs, fmt.Errorf("ignoring invalid ssh_options: %s", strings.Join(invalid, ", "))
+	}
+	return pairs, nil
+}
+
+var verboseFlagRe = regexp.MustCompile(`^-v+$`)
+
+var optionNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// sshuttleOptionArgs renders an options map as sorted --key=value flags,
+// skipping (and reporting) keys that don't look like sshuttle long options.
+func sshuttleOptionArgs(options map[string]string) ([]string, error) {
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var args []string
+	var invalid []string
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, "--")
+		if !optionNameRe.MatchString(name) {
+			invalid = append(invalid, key)
+			continue
+		}
+		if value := options[key]; value != "" {
+			args = append(args, fmt.Sprintf("--%s=%s", name, shellQuote(value)))
+		} else {
+			args = append(args, "--"+name)
+		}
+	}
+
+	if len(invalid) > 0 {
+		return args, fmt.Errorf("ignoring invalid option names: %s", strings.Join(invalid, ", "))
+	}
+	return args, nil
+}
+
+// dropFlags removes the given flags from an argument string, returning the
+// remaining arguments and the flags that were dropped. flags maps each flag
+// to whether it takes a separate value argument, which is dropped with it
+// unless given inline as --flag=value.
+func dropFlags(args string, flags map[string]bool) (string, []string) {
+	if len(flags) == 0 {
+		return args, nil
+	}
+
+	tokens, err := splitArgs(args)
+	if err != nil {
+		return args, nil
+	}
+
+	var kept, dropped []string
+	for i := 0; i < len(tokens); i++ {
+		name, _, hasValue := strings.Cut(tokens[i], "=")
+		takesValue, ok := flags[name]
+		if !ok {
+			kept = append(kept, shellQuote(tokens[i]))
+			continue
+		}
+		dropped = append(dropped, name)
+		if takesValue && !hasValue && i+1 < len(tokens) {
+			i++
+		}
+	}
+	return strings.Join(kept, " "), dropped
+}
+
+var shellSafeRe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./~-]+$`)
+
+// shellQuote quotes s for sh when it contains anything beyond safe characters.
+func shellQuote(s string) string {
+	if shellSafeRe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// sshuttleErrorHints turn known sshuttle failures into advice. sshuttle
+// runs a Python server on the remote host, and a missing or old Python
+// there is the most common reason it fails, with a confusing traceback.
+var sshuttleErrorHints = []struct {
+	pattern *regexp.Regexp
+	hint    string
+}{
+	{
+		regexp.MustCompile(`(?i)python[0-9.]*: (command )?not found|python[0-9.]*: no such file|server died with error code 127`),
+		"The remote host has no Python, which sshuttle runs there: install python3 on it, or set options: {python: /path/to/python3} on the tunnel if it is somewhere else",
+	},
+	{
+		regexp.MustCompile(`(?i)must be root|sudo: (a terminal is required|no tty present|a password is required)`),
+		"sshuttle couldn't get root for its firewall rules: set sudo: true on the tunnel or run with -sudo to start it through sudo",
+	},
+	{
+		regexp.MustCompile(`(?i)SyntaxError|python version|requires python`),
+		"The remote host's Python is too old for this sshuttle: install a newer python3 on it, or set options: {python: /path/to/python3} on the tunnel to use another one",
+	},
+}
+
+// stderrTail is how much of a tunnel's stderr tailBuffer keeps.
+const stderrTail = 8 << 10
+
+// tailBuffer keeps the last stderrTail bytes written to it, enough for
+// sshuttleErrorHint to match the error a tunnel exited with however long
+// it ran.
+type tailBuffer struct {
+	data []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	if over := len(b.data) - stderrTail; over > 0 {
+		b.data = append(b.data[:0], b.data[over:]...)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.data)
+}
+
+// sshuttleErrorHint returns advice for the output of a failed sshuttle,
+// or "" when it isn't a known failure.
+func sshuttleErrorHint(output string) string {
+	for _, known := range sshuttleErrorHints {
+		if known.pattern.MatchString(output) {
+			return known.hint
+		}
+	}
+	return ""
+}
+
+// isSshuttleCommand reports whether command invokes sshuttle directly.
+func isSshuttleCommand(command string) bool {
+	fields := strings.Fields(command)
+	return len(fields) > 0 && filepath.Base(fields[0]) == "sshuttle"
+}
+
+// sshuttleCommandLine drops what ps shows before the sshuttle executable,
+// such as the python interpreter.
+func sshuttleCommandLine(command string) string {
+	fields := strings.Fields(command)
+	for idx, field := range fields {
+		if filepath.Base(field) == "sshuttle" {
+			return strings.Join(fields[idx:], " ")
+		}
+	}
+	return command
+}
+
+// sshuttleArgs is an sshuttle command line split into the parts the
+// selector cares about.
+type sshuttleArgs struct {
+	Remote      string   // as given to -r, usually user@host
+	Subnets     []string // bare IPs are widened to /32 or /128
+	Excludes    []string // -x/--exclude values
+	ExcludeFrom string
+	SSHCmd      string // contents of --ssh-cmd
+	Daemon      bool
+	Verbose     int
+	Flags       []string // everything else, option values kept after their flag
+}
+
+// parseSshuttleArgs parses an sshuttle command line. Anything before the
+// sshuttle executable, such as the python interpreter shown by ps, is
+// skipped.
+func parseSshuttleArgs(command string) (sshuttleArgs, error) {
+	var parsed sshuttleArgs
+
+	args, err := splitArgs(command)
+	if err != nil {
+		return parsed, err
+	}
+	start := -1
+	for i, arg := range args {
+		if filepath.Base(arg) == "sshuttle" {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return parsed, fmt.Errorf("not an sshuttle command")
+	}
+
+	// value returns the argument following args[i], advancing i
+	value := func(i *int) string {
+		if *i+1 < len(args) {
+			*i++
+			return args[*i]
+		}
+		return ""
+	}
+
+	for i := start + 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-r" || arg == "--remote":
+			parsed.Remote = value(&i)
+		case strings.HasPrefix(arg, "--remote="):
+			parsed.Remote = strings.TrimPrefix(arg, "--remote=")
+		case strings.HasPrefix(arg, "-r") && len(arg) > 2:
+			parsed.Remote = arg[2:]
+		case arg == "-e" || arg == "--ssh-cmd" || strings.HasPrefix(arg, "--ssh-cmd="):
+			if arg == "-e" || arg == "--ssh-cmd" {
+				parsed.SSHCmd = value(&i)
+			} else {
+				parsed.SSHCmd = strings.TrimPrefix(arg, "--ssh-cmd=")
+			}
+			// ps joins argv with spaces, losing the quotes around the ssh
+			// command, so take back the ssh options that follow it
+			for i+1 < len(args) && sshOnlyOptions[args[i+1]] {
+				parsed.SSHCmd += " " + args[i+1]
+				i++
+				if i+1 < len(args) {
+					parsed.SSHCmd += " " + shellQuote(args[i+1])
+					i++
+				}
+			}
+		case arg == "-x" || arg == "--exclude":
+			parsed.Excludes = append(parsed.Excludes, value(&i))
+		case strings.HasPrefix(arg, "--exclude="):
+			parsed.Excludes = append(parsed.Excludes, strings.TrimPrefix(arg, "--exclude="))
+		case strings.HasPrefix(arg, "-x") && len(arg) > 2:
+			parsed.Excludes = append(parsed.Excludes, arg[2:])
+		case arg == "-X" || arg == "--exclude-from":
+			parsed.ExcludeFrom = value(&i)
+		case strings.HasPrefix(arg, "--exclude-from="):
+			parsed.ExcludeFrom = strings.TrimPrefix(arg, "--exclude-from=")
+		case arg == "-D" || arg == "--daemon":
+			parsed.Daemon = true
+		case verboseFlagRe.MatchString(arg):
+			parsed.Verbose += len(arg) - 1
+		case arg == "--verbose":
+			parsed.Verbose++
+		case sshuttleValueOptions[arg]:
+			parsed.Flags = append(parsed.Flags, arg, value(&i))
+		case !strings.HasPrefix(arg, "-"):
+			// Subnets are usually separate arguments, but a list may come
+			// joined with commas in one
+			var subnets []string
+			for _, field := range subnetFields(arg) {
+				subnet, ok := subnetArg(field)
+				if !ok {
+					subnets = nil
+					break
+				}
+				subnets = append(subnets, subnet)
+			}
+			if len(subnets) > 0 {
+				parsed.Subnets = append(parsed.Subnets, subnets...)
+			} else {
+				parsed.Flags = append(parsed.Flags, arg)
+			}
+		default:
+			parsed.Flags = append(parsed.Flags, arg)
+		}
+	}
+
+	return parsed, nil
+}
+
+// subnetArg returns the subnet arg names, widening a bare IP to /32 or
+// /128, and whether it is one at all.
+func subnetArg(arg string) (string, bool) {
+	if arg == "0/0" {
+		return arg, true
+	}
+	if _, _, err := net.ParseCIDR(arg); err == nil {
+		return arg, true
+	}
+	if ip := net.ParseIP(arg); ip != nil {
+		if ip.To4() != nil {
+			return arg + "/32", true
+		}
+		return arg + "/128", true
+	}
+	return "", false
+}
+
+// parseSshuttleCommand reverse-parses an sshuttle command line into a
+// TunnelConfig, keeping options it doesn't model in ExtraArgs. Mode flags
+// (-v, --daemon) are dropped since the selector adds them itself.
+func parseSshuttleCommand(command string) (TunnelConfig, error) {
+	var tunnel TunnelConfig
+
+	parsed, err := parseSshuttleArgs(command)
+	if err != nil {
+		return tunnel, err
+	}
+
+	user, host, found := strings.Cut(parsed.Remote, "@")
+	if !found || user == "" || host == "" {
+		return tunnel, fmt.Errorf("remote must be given as -r user@host")
+	}
+	if len(parsed.Subnets) == 0 {
+		return tunnel, fmt.Errorf("no subnets found")
+	}
+
+	tunnel.User = user
+	tunnel.Host = host
+	tunnel.Subnets = strings.Join(parsed.Subnets, ",")
+	tunnel.ExcludeFrom = parsed.ExcludeFrom
+
+	var extra []string
+	for _, exclude := range parsed.Excludes {
+		extra = append(extra, "-x", exclude)
+	}
+	extra = append(extra, parsed.Flags...)
+
+	// Only the identity file is carried over from the ssh command
+	if sshArgs, err := splitArgs(parsed.SSHCmd); err == nil {
+		for i := 0; i+1 < len(sshArgs); i++ {
+			if sshArgs[i] == "-i" {
+				extra = append(extra, "-i", sshArgs[i+1])
+				break
+			}
+		}
+	}
+	tunnel.ExtraArgs = ExtraArgs{Line: strings.Join(extra, " ")}
+
+	return tunnel, nil
+}
+
+// hostRoutedWarnings resolves host and reports any of its addresses that
+// fall inside the tunneled subnets, which would route the SSH connection
+// into its own tunnel. Hosts that don't resolve are not reported.
+func hostRoutedWarnings(host, subnets string) []string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return nil
+	}
+
+	var warnings []string
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		for _, subnet := range strings.Split(subnets, ",") {
+			_, ipNet, err := net.ParseCIDR(strings.TrimSpace(subnet))
+			if err != nil || !ipNet.Contains(ip) {
+				continue
+			}
+			// A full tunnel already gets local exclusions and sshuttle
+			// handles its own server there, so only flag narrower routes
+			if ones, _ := ipNet.Mask.Size(); ones == 0 {
+				continue
+			}
+			warnings = append(warnings, fmt.Sprintf("%s (%s) is inside tunneled subnet %s, consider adding -x %s", host, addr, ipNet, addr))
+		}
+	}
+	return warnings
+}
+
+// routesAllTraffic reports whether subnets contains a default route.
+func routesAllTraffic(subnets string) bool {
+	for _, subnet := range strings.Split(subnets, ",") {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(subnet))
+		if err != nil {
+			continue
+		}
+		if ones, _ := ipNet.Mask.Size(); ones == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func allTrafficWarning(destination string) string {
+	return fmt.Sprintf("WARNING: ALL traffic will be routed through %s (local subnets are excluded)", destination)
+}
+
+// localSubnets returns the networks of the machine's own interfaces, used to
+// exclude them from full tunnels so the local network stays reachable.
+func localSubnets() []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	var subnets []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		network := &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask}
+		subnets = append(subnets, network.String())
+	}
+	return subnets
+}
+
+// systemRoute is an entry of the local routing table.
+type systemRoute struct {
+	destination *net.IPNet
+	line        string // as printed by the routing tool
+}
+
+// systemRoutes reads the IPv4 routing table with ip route on Linux and
+// netstat on macOS.
+func systemRoutes() ([]systemRoute, error) {
+	var routes []systemRoute
+	switch runtime.GOOS {
+	case "linux":
+		output, err := exec.Command("ip", "-4", "route", "show").Output()
+		if err != nil {
+			return nil, fmt.Errorf("ip route failed: %v", err)
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			destination := fields[0]
+			if destination == "default" {
+				destination = "0.0.0.0/0"
+			} else if !strings.Contains(destination, "/") {
+				destination += "/32"
+			}
+			if _, network, err := net.ParseCIDR(destination); err == nil {
+				routes = append(routes, systemRoute{destination: network, line: strings.TrimSpace(line)})
+			}
+		}
+
+	case "darwin":
+		output, err := exec.Command("netstat", "-rn", "-f", "inet").Output()
+		if err != nil {
+			return nil, fmt.Errorf("netstat failed: %v", err)
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			if network := parseNetstatDestination(fields[0]); network != nil {
+				routes = append(routes, systemRoute{destination: network, line: strings.Join(fields, " ")})
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("reading routes is not supported on %s", runtime.GOOS)
+	}
+	return routes, nil
+}
+
+// parseNetstatDestination parses macOS netstat destinations, which drop
+// trailing zero octets ("10/8") or the mask ("192.168.1" is a /24).
+func parseNetstatDestination(destination string) *net.IPNet {
+	if destination == "default" {
+		destination = "0/0"
+	}
+	address, bits, hasBits := strings.Cut(destination, "/")
+	octets := strings.Split(address, ".")
+	if len(octets) > 4 {
+		return nil
+	}
+	if !hasBits {
+		bits = strconv.Itoa(len(octets) * 8)
+	}
+	for len(octets) < 4 {
+		octets = append(octets, "0")
+	}
+	_, network, err := net.ParseCIDR(strings.Join(octets, ".") + "/" + bits)
+	if err != nil {
+		return nil
+	}
+	return network
+}
+
+// routePreview describes the subnets tunnel would route and the current
+// routes that overlap them, which the tunnel takes over while it's up. The
+// default route and loopback are left out as they overlap every tunnel.
+func routePreview(tunnel TunnelConfig) string {
+	subnets, _ := tunnelSubnets(tunnel)
+	routesAll := false
+	var b strings.Builder
+	b.WriteString("Routed through the tunnel:\n")
+	for _, network := range parseSubnetList(subnets) {
+		fmt.Fprintf(&b, "  %s\n", network)
+		if ones, _ := network.Mask.Size(); ones == 0 {
+			routesAll = true
+		}
+	}
+	if routesAll {
+		b.WriteString("Excluded (local networks):\n")
+		for _, subnet := range localSubnets() {
+			fmt.Fprintf(&b, "  %s\n", subnet)
+		}
+	}
+
+	routes, err := systemRoutes()
+	if err != nil {
+		fmt.Fprintf(&b, "\nCan't check current routes: %v\n", err)
+		return b.String()
+	}
+
+	local := strings.Join(localSubnets(), ",")
+	var shadowed []string
+	for _, route := range routes {
+		if ones, _ := route.destination.Mask.Size(); ones == 0 || route.destination.IP.IsLoopback() {
+			continue
+		}
+		if routesAll && subnetsOverlap(route.destination.String(), local) {
+			continue
+		}
+		if subnetsOverlap(route.destination.String(), subnets) {
+			shadowed = append(shadowed, route.line)
+		}
+	}
+	if len(shadowed) == 0 {
+		b.WriteString("\nNo current routes are shadowed\n")
+		return b.String()
+	}
+	b.WriteString("\nCurrent routes that will be shadowed:\n")
+	for _, line := range shadowed {
+		fmt.Fprintf(&b, "  %s\n", line)
+	}
+	return b.String()
+}
+
+// subnetTemplateFor returns the subnets of the most specific subnet_templates
+// glob matching host, or "" if none match.
+func subnetTemplateFor(config *Config, host string) string {
+	best := ""
+	for pattern := range config.SubnetTemplates {
+		if matched, err := filepath.Match(pattern, host); err != nil || !matched {
+			continue
+		}
+		if len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best) {
+			best = pattern
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return config.SubnetTemplates[best]
+}
+
+// checkListenAvailable probes each address in an sshuttle --listen value
+// ([ip:]port, comma-separated) and fails if one can't be bound, usually
+// because another tunnel already uses it. Port 0
+// lets sshuttle pick a free port, so it's not checked.
+func checkListenAvailable(listen string) error {
+	for _, addr := range strings.Split(listen, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if !strings.Contains(addr, ":") {
+			// A bare port listens on localhost
+			addr = "127.0.0.1:" + addr
+		}
+		if _, port, err := net.SplitHostPort(addr); err == nil && port == "0" {
+			continue
+		}
+
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("listen address %s is not available: %v", addr, err)
+		}
+		listener.Close()
+	}
+	return nil
+}
+
+// splitSubnets splits comma- or space-separated subnets as written.
+func splitSubnets(subnets string) []string {
+	return append([]string{}, subnetFields(subnets)...)
+}
+
+// parseSubnetList parses comma- or space-separated subnets, accepting
+// sshuttle's 0/0 shorthand and skipping entries that don't parse.
+func parseSubnetList(subnets string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, subnet := range subnetFields(subnets) {
+		subnet = expandSubnet(subnet)
+		if subnet == "0/0" {
+			subnet = "0.0.0.0/0"
+		}
+		if _, network, err := net.ParseCIDR(subnet); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// overlapWarnings warns about the running tunnels whose subnets overlap
+// subnets of the tunnel name. sshuttle doesn't coordinate tunnels, so
+// traffic to the overlap goes through whichever set its firewall rules
+// last.
+func overlapWarnings(name, subnets string, running []activeTunnel) []string {
+	var warnings []string
+	for _, tunnel := range running {
+		if subnetsOverlap(subnets, strings.Join(tunnel.Args.Subnets, ",")) {
+			warnings = append(warnings, fmt.Sprintf("%s and %s (PID %d) route overlapping subnets", name, tunnel.Destination, tunnel.PID))
+		}
+	}
+	return warnings
+}
+
+// subnetsOverlap reports whether any subnet in a overlaps any subnet in b.
+func subnetsOverlap(a, b string) bool {
+	for _, x := range parseSubnetList(a) {
+		for _, y := range parseSubnetList(b) {
+			if x.Contains(y.IP) || y.Contains(x.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sshuttleMethods are the values sshuttle accepts for --method.
+var sshuttleMethods = []string{"auto", "nat", "nft", "tproxy", "pf", "ipfw", "windivert"}
+
+// validateNSHosts checks that ns_hosts lists IP addresses, as sshuttle
+// doesn't resolve names there.
+func validateNSHosts(hosts string) error {
+	fields := subnetFields(hosts)
+	if len(fields) == 0 {
+		return fmt.Errorf("no name servers given")
+	}
+	for _, host := range fields {
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid name server IP '%s'", host)
+		}
+	}
+	return nil
+}
+
+func validateMethod(method string) error {
+	if method == "" || containsString(sshuttleMethods, method) {
+		return nil
+	}
+	return fmt.Errorf("invalid method '%s' (want %s)", method, strings.Join(sshuttleMethods, ", "))
+}
+
+// familySubnets splits comma-separated subnets into those matching family
+// ("4", "6" or "" for both) and those that don't. Entries that don't parse
+// are kept for sshuttle to report.
+func familySubnets(family, subnets string) (string, []string) {
+	if family != "4" && family != "6" {
+		return subnets, nil
+	}
+
+	var kept, mismatched []string
+	for _, subnet := range splitSubnets(subnets) {
+		cidr := subnet
+		if cidr == "0/0" {
+			cidr = "0.0.0.0/0"
+		}
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil || (ip.To4() != nil) == (family == "4") {
+			kept = append(kept, subnet)
+		} else {
+			mismatched = append(mismatched, subnet)
+		}
+	}
+	return strings.Join(kept, ","), mismatched
+}
+
+// validateFamily checks a family value and, if subnets are given, that
+// they all match it.
+func validateFamily(family, subnets string) error {
+	if family != "" && family != "4" && family != "6" {
+		return fmt.Errorf("invalid family '%s' (want 4, 6 or empty for both)", family)
+	}
+	if _, mismatched := familySubnets(family, subnets); len(mismatched) > 0 {
+		return fmt.Errorf("subnets %s don't match family %s", strings.Join(mismatched, ", "), family)
+	}
+	return nil
+}
+
+// expandSubnet expands shorthand for a single subnet: "10." or "10.*" is
+// 10.0.0.0/8, "192.168." is 192.168.0.0/16, "10.1.2." is 10.1.2.0/24 and a
+// bare IP is a /32 (/128 for IPv6). Anything else, including full CIDRs and
+// sshuttle's 0/0, is returned unchanged.
+func expandSubnet(subnet string) string {
+	if ip := net.ParseIP(subnet); ip != nil {
+		if ip.To4() != nil {
+			return subnet + "/32"
+		}
+		return subnet + "/128"
+	}
+
+	prefix := strings.TrimSuffix(subnet, "*")
+	if !strings.HasSuffix(prefix, ".") {
+		return subnet
+	}
+	octets := strings.Split(strings.TrimSuffix(prefix, "."), ".")
+	if len(octets) > 3 {
+		return subnet
+	}
+	for _, octet := range octets {
+		if n, err := strconv.Atoi(octet); err != nil || n < 0 || n > 255 {
+			return subnet
+		}
+	}
+	bits := len(octets) * 8
+	for len(octets) < 4 {
+		octets = append(octets, "0")
+	}
+	return fmt.Sprintf("%s/%d", strings.Join(octets, "."), bits)
+}
+
+// subnetFields splits subnets separated by commas, whitespace or both, as
+// in "10.0.0.0/8, 192.168.0.0/16" or sshuttle's "10.0.0.0/8 192.168.0.0/16".
+func subnetFields(subnets string) []string {
+	return strings.FieldsFunc(subnets, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// normalizeSubnets expands shorthand in comma- or space-separated subnets,
+// see expandSubnet, and joins them with commas as they are stored.
+func normalizeSubnets(subnets string) string {
+	parts := subnetFields(subnets)
+	for i, subnet := range parts {
+		parts[i] = expandSubnet(subnet)
+	}
+	return strings.Join(parts, ",")
+}
+
+func validateSubnets(subnets string) error {
+	// Split by comma or space and validate each CIDR, allowing shorthand
+	subnetsSlice := subnetFields(subnets)
+	if len(subnetsSlice) == 0 {
+		return fmt.Errorf("no subnets given")
+	}
+	for _, subnet := range subnetsSlice {
+		if _, _, err := net.ParseCIDR(expandSubnet(subnet)); err != nil {
+			return fmt.Errorf("invalid CIDR '%s': %v", subnet, err)
+		}
+	}
+	return nil
+}
+
+func validateSSHConnection(tunnel TunnelConfig) error {
+	return validateSSHConnectionContext(context.Background(), tunnel)
+}
+
+func validateSSHConnectionContext(ctx context.Context, tunnel TunnelConfig) error {
+	timeout := tunnel.ConnectTimeout
+	if timeout <= 0 {
+		timeout = defaultConnectTimeout
+	}
+
+	// Build SSH test command
+	sshArgs := []string{"-o", fmt.Sprintf("ConnectTimeout=%d", timeout), "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=" + tunnelHostKeyChecking(tunnel)}
+
+	// Parse extra args for SSH key
+	if args, _ := parseExtraArgs(tunnel.ExtraArgs.String()); args.identityFile != "" {
+		sshArgs = append(sshArgs, "-i", args.identityFile)
+	}
+
+	if proxyCommand := tunnelProxyCommand(tunnel); proxyCommand != "" {
+		sshArgs = append(sshArgs, "-o", "ProxyCommand="+proxyCommand)
+	}
+	options, _ := sshOptionPairs(tunnel.SSHOptions)
+	for _, option := range options {
+		sshArgs = append(sshArgs, "-o", option)
+	}
+
+	// Add user@host
+	sshArgs = append(sshArgs, fmt.Sprintf("%s@%s", tunnel.User, tunnel.Host), "exit")
+
+	// Test SSH connection, reporting ssh's own reason when it fails
+	cmd := exec.CommandContext(ctx, "ssh", sshArgs...)
+	cmd.Env = tunnelEnv(tunnel.Env)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		if reason := strings.TrimSpace(lines[len(lines)-1]); reason != "" {
+			return fmt.Errorf("%s", reason)
+		}
+		return err
+	}
+	return nil
+}
+
+// tunnelEnv returns the parent environment with env layered on top, or nil
+// (inherit unchanged) when env is empty.
+func tunnelEnv(env map[string]string) []string {
+	if len(env) == 0 {
+		return nil
+	}
+
+	// exec uses the last value when a key is repeated
+	return append(os.Environ(), envAssignments(env)...)
+}
+
+// envAssignments renders env as KEY=value entries sorted by key.
+func envAssignments(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	assignments := make([]string, 0, len(keys))
+	for _, key := range keys {
+		assignments = append(assignments, key+"="+env[key])
+	}
+	return assignments
+}
+
+// userHomeDir is os.UserHomeDir, falling back to the passwd entry of the
+// current user when $HOME is unset, as in minimal containers.
+func userHomeDir() (string, error) {
+	if homeDir, err := os.UserHomeDir(); err == nil {
+		return homeDir, nil
+	}
+	if u, err := user.Current(); err == nil && u.HomeDir != "" {
+		return u.HomeDir, nil
+	}
+	return "", fmt.Errorf("can't determine the home directory: set HOME or XDG_CONFIG_HOME")
+}
+
+// configDir returns the directory holding the config and state files,
+// ~/.config/sshuttle-selector. $XDG_CONFIG_HOME is used when there is no
+// home directory at all.
+func configDir() (string, error) {
+	homeDir, err := userHomeDir()
+	if err == nil {
+		return filepath.Join(homeDir, ".config", "sshuttle-selector"), nil
+	}
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		return filepath.Join(xdg, "sshuttle-selector"), nil
+	}
+	return "", err
+}
+
+// configPath returns the config file to read and write: the -config path,
+// or config.yaml in configDir.
+func configPath() (string, error) {
+	if configFile != "" {
+		return configFile, nil
+	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.yaml"), nil
+}
+
+// expandPath expands a leading ~ and environment variables in path.
+func expandPath(path string) string {
+	path = os.ExpandEnv(path)
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if homeDir, err := userHomeDir(); err == nil {
+			path = filepath.Join(homeDir, path[1:])
+		}
+	}
+	return path
+}
+
+// activityLog records tunnel starts and stops, see logActivity. It is nil
+// with -no-log.
+var activityLog *log.Logger
+
+// activityLogMax is the size past which the activity log is moved to
+// activity.log.1 when it is opened, replacing the previous one.
+const activityLogMax = 1 << 20
+
+// openActivityLog opens the activity log at path for appending, rotating
+// it first when it has grown past activityLogMax. Warnings of the standard
+// logger are written to it too.
+func openActivityLog(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil && info.Size() > activityLogMax {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	activityLog = log.New(file, "", 0)
+	log.SetOutput(io.MultiWriter(os.Stderr, file))
+	return nil
+}
+
+// logActivity appends an event such as a tunnel start or stop to the
+// activity log as key=value fields, leaving out empty ones.
+func logActivity(action, name, destination string, pid int, status string) {
+	if activityLog == nil {
+		return
+	}
+	fields := []string{"time=" + time.Now().Format(time.RFC3339), "action=" + action}
+	if name != "" {
+		fields = append(fields, "name="+strconv.Quote(name))
+	}
+	if destination != "" {
+		fields = append(fields, "destination="+destination)
+	}
+	if pid != 0 {
+		fields = append(fields, fmt.Sprintf("pid=%d", pid))
+	}
+	if status != "" {
+		fields = append(fields, "status="+strconv.Quote(status))
+	}
+	activityLog.Println(strings.Join(fields, " "))
+}
+
+// exitStatus describes how a command ended, for the activity log.
+func exitStatus(err error) string {
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return "exit 0"
+	case errors.As(err, &exitErr):
+		return fmt.Sprintf("exit %d", exitErr.ExitCode())
+	default:
+		return err.Error()
+	}
+}
+
+// startDetached runs command in a new session with its output appended to a
+// log file, so the tunnel survives the terminal being closed.
+func startDetached(command string, env map[string]string) (int, string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return 0, "", err
+	}
+
+	logPath := filepath.Join(dir, "detached.log")
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		return 0, "", err
+	}
+
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, "", err
+	}
+	defer logFile.Close()
+
+	// The tunnel leaves our session entirely, so it outlives the terminal
+	cmd := exec.Command("sh", "-c", command)
+	detachProcess(cmd)
+	cmd.Env = tunnelEnv(env)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+
+	if err := cmd.Start(); err != nil {
+		return 0, "", err
+	}
+
+	pid := cmd.Process.Pid
+	if err := cmd.Process.Release(); err != nil {
+		return 0, "", err
+	}
+
+	return pid, logPath, nil
+}
+
+func loadOrCreateConfig() (*Config, error) {
+	configPath, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+
+	// Create directory if it doesn't exist
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return nil, configIOError(configPath, err)
+	}
+
+	// Check if config file exists
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		// Return empty config, checking host keys on first use
+		config := &Config{Tunnels: []TunnelConfig{}, HostKeyChecking: "accept-new"}
+		setHostKeyChecking(config)
+		return config, nil
+	}
+
+	// Load existing config
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, configIOError(configPath, err)
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, configParseError(configPath, err)
+	}
+	config.Tunnels = trimTunnels(config.Tunnels)
+	setHostKeyChecking(&config)
+
+	return &config, nil
+}
+
+// expandUsers returns tunnels with each tunnel that lists users replaced by
+// one copy per user. The config itself keeps the single entry.
+func expandUsers(tunnels []TunnelConfig) []TunnelConfig {
+	var expanded []TunnelConfig
+	for _, tunnel := range tunnels {
+		if len(tunnel.Users) == 0 {
+			expanded = append(expanded, tunnel)
+			continue
+		}
+		for _, user := range tunnel.Users {
+			variant := tunnel
+			variant.User = strings.TrimSpace(user)
+			variant.Users = nil
+			variant.Alias = "" // would be shared by every variant
+			variant.Name = fmt.Sprintf("%s (%s)", tunnel.Name, variant.User)
+			expanded = append(expanded, variant)
+		}
+	}
+	return expanded
+}
+
+// trimTunnels strips whitespace around user and host, which is easy to
+// paste in and breaks user@host.
+func trimTunnels(tunnels []TunnelConfig) []TunnelConfig {
+	for i := range tunnels {
+		tunnels[i].User = strings.TrimSpace(tunnels[i].User)
+		tunnels[i].Host = strings.TrimSpace(tunnels[i].Host)
+	}
+	return tunnels
+}
+
+// validateUserHost rejects a user or host that would produce a broken
+// user@host destination.
+func validateUserHost(user, host string) error {
+	if strings.ContainsAny(user, " \t\n@") {
+		return fmt.Errorf("user '%s' must not contain whitespace or @", user)
+	}
+	if strings.ContainsAny(host, " \t\n") {
+		return fmt.Errorf("host '%s' must not contain whitespace", host)
+	}
+	return nil
+}
+
+var yamlLineRe = regexp.MustCompile(`^line (\d+): `)
+
+// configParseError rewrites a yaml error as path:line: message, one line
+// per problem, and points at -validate.
+func configParseError(path string, err error) error {
+	var problems []string
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		problems = typeErr.Errors
+	} else {
+		problems = []string{strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+
+	for i, problem := range problems {
+		if m := yamlLineRe.FindStringSubmatch(problem); m != nil {
+			problems[i] = fmt.Sprintf("%s:%s: %s", path, m[1], problem[len(m[0]):])
+		} else {
+			problems[i] = fmt.Sprintf("%s: %s", path, problem)
+		}
+	}
+
+	return &ConfigError{
+		Kind: ConfigParse,
+		Path: path,
+		Err:  fmt.Errorf("invalid config %s", strings.Join(problems, "; ")),
+		Hint: "run with -validate to check it",
+	}
+}
+
+// ConfigErrorKind says what went wrong in a config operation.
+type ConfigErrorKind int
+
+const (
+	ConfigNotFound ConfigErrorKind = iota + 1 // the file doesn't exist
+	ConfigParse                               // the file isn't valid YAML for a Config
+	ConfigInvalid                             // the config has problems
+	ConfigIO                                  // the file can't be read or written
+)
+
+// ConfigError is returned by loadOrCreateConfig, saveConfig and
+// handleValidateCommand so callers can react to the kind of failure
+// instead of matching messages.
+type ConfigError struct {
+	Kind ConfigErrorKind
+	Path string
+	Err  error
+	Hint string // what to do about it, appended to the message
+}
+
+func (e *ConfigError) Error() string {
+	if e.Hint != "" {
+		return fmt.Sprintf("%v (%s)", e.Err, e.Hint)
+	}
+	return e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// configIOError wraps a failure to read or write the config at path.
+func configIOError(path string, err error) error {
+	if os.IsNotExist(err) {
+		return &ConfigError{Kind: ConfigNotFound, Path: path, Err: err}
+	}
+	return &ConfigError{Kind: ConfigIO, Path: path, Err: err}
+}
+
+// configExitCodes are the exit codes for config errors, so scripts can tell
+// them apart from other failures, which exit with 1.
+var configExitCodes = map[ConfigErrorKind]int{
+	ConfigNotFound: 3,
+	ConfigParse:    4,
+	ConfigInvalid:  5,
+	ConfigIO:       6,
+}
+
+// exitWithError prints err and exits with the code for its kind.
+func exitWithError(err error) {
+	code := 1
+	var configErr *ConfigError
+	if errors.As(err, &configErr) {
+		code = configExitCodes[configErr.Kind]
+		if configErr.Kind == ConfigIO && os.IsPermission(configErr.Err) {
+			err = fmt.Errorf("%v (check the permissions of %s)", err, configErr.Path)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	os.Exit(code)
+}
+
+// configProblems is every problem validateConfig found, one per line.
+type configProblems []string
+
+func (p configProblems) Error() string {
+	return fmt.Sprintf("%d problems found:\n  %s", len(p), strings.Join(p, "\n  "))
+}
+
+// validateConfig checks config for the problems that would break its
+// tunnels: missing fields, duplicate names and invalid subnets. It returns
+// a configProblems listing all of them with the tunnel they are in, or nil.
+// Settings that are ignored or only break part of a tunnel are reported by
+// configWarnings instead.
+func validateConfig(config *Config) error {
+	var problems configProblems
+	tunnels := trimTunnels(expandUsers(config.Tunnels))
+	names := make(map[string]int)
+	for _, tunnel := range tunnels {
+		names[normalizeName(tunnel.Name)]++
+	}
+	reported := make(map[string]bool)
+	for i, tunnel := range tunnels {
+		label := tunnel.Name
+		if label == "" {
+			label = fmt.Sprintf("tunnel %d", i+1)
+		}
+		if tunnel.Name == "" {
+			problems = append(problems, fmt.Sprintf("%s: name is required", label))
+		}
+		if tunnel.Host == "" {
+			problems = append(problems, fmt.Sprintf("%s: host is required", label))
+		}
+		if tunnel.User == "" {
+			problems = append(problems, fmt.Sprintf("%s: user is required", label))
+		}
+		if key := normalizeName(tunnel.Name); key != "" && names[key] > 1 && !reported[key] {
+			problems = append(problems, fmt.Sprintf("%s: name is used by %d tunnels", label, names[key]))
+			reported[key] = true
+		}
+		if err := validateUserHost(tunnel.User, tunnel.Host); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", label, err))
+		}
+		if tunnel.Subnets != "" || tunnel.SubnetsFrom == "" {
+			if err := validateSubnets(tunnel.Subnets); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid subnets: %v", label, err))
+			}
+		}
+	}
+	if config.DefaultSubnets != "" {
+		if err := validateSubnets(config.DefaultSubnets); err != nil {
+			problems = append(problems, fmt.Sprintf("default_subnets: %v", err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// configWarnings returns the problems in config that don't stop its
+// tunnels from starting, such as a missing subnets_from file or a setting
+// that is ignored. The list shows them in its warnings panel.
+func configWarnings(config *Config) []string {
+	var warnings []string
+	for _, tunnel := range trimTunnels(expandUsers(config.Tunnels)) {
+		label := tunnel.Name
+		if tunnel.SubnetsFrom != "" {
+			_, subnetWarnings := tunnelSubnets(tunnel)
+			warnings = append(warnings, subnetWarnings...)
+		}
+		if err := validateProxyCommand(tunnel.ProxyCommand); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: invalid proxy_command: %v", label, err))
+		}
+		if err := validateSSMInstance(tunnel); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v", label, err))
+		}
+		if _, err := sshOptionPairs(tunnel.SSHOptions); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v", label, err))
+		}
+		if err := validateHostKeyChecking(tunnel); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v", label, err))
+		}
+		if err := validateProbe(tunnel); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v", label, err))
+		}
+		subnets, _ := tunnelSubnets(tunnel)
+		if err := validateFamily(tunnel.Family, subnets); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v", label, err))
+		}
+		if err := validateMethod(tunnel.Method); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v", label, err))
+		}
+		if tunnel.Exclude != "" {
+			if err := validateSubnets(tunnel.Exclude); err != nil {
+				warnings = append(warnings, fmt.Sprintf("%s: ignoring exclude: %v", label, err))
+			}
+		}
+		if tunnel.NSHosts != "" {
+			if err := validateNSHosts(tunnel.NSHosts); err != nil {
+				warnings = append(warnings, fmt.Sprintf("%s: ignoring ns_hosts: %v", label, err))
+			}
+		}
+		if strings.ContainsAny(tunnel.Alias, " \t") {
+			warnings = append(warnings, fmt.Sprintf("%s: alias '%s' contains whitespace", label, tunnel.Alias))
+		}
+	}
+	warnings = append(warnings, duplicateAliases(config.Tunnels)...)
+	for _, tunnel := range config.Tunnels {
+		if tunnel.Alias != "" && len(tunnel.Users) > 0 {
+			warnings = append(warnings, fmt.Sprintf("%s: alias is ignored with users", tunnel.Name))
+		}
+	}
+	if _, err := resolveKeybindings(config.Keybindings); err != nil {
+		warnings = append(warnings, fmt.Sprintf("Ignoring keybindings: %v", err))
+	}
+	return warnings
+}
+
+// handleValidateCommand loads the config and reports every problem found
+// in it, failing if there are any.
+func handleValidateCommand() error {
+	config, err := loadOrCreateConfig()
+	if err != nil {
+		// This is the check the hint points at
+		var configErr *ConfigError
+		if errors.As(err, &configErr) {
+			configErr.Hint = ""
+		}
+		return err
+	}
+
+	for _, warning := range configWarnings(config) {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+	var problems configProblems
+	if errors.As(validateConfig(config), &problems) {
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		return &ConfigError{Kind: ConfigInvalid, Err: fmt.Errorf("%d problems found", len(problems))}
+	}
+	fmt.Printf("Config OK (%d tunnels)\n", len(expandUsers(config.Tunnels)))
+	return nil
+}
+
+func statePath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "state.yaml"), nil
+}
+
+// loadState reads the state file, returning an empty state if it doesn't exist.
+func loadState() (*State, error) {
+	path, err := statePath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &State{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state State
+	if err := yaml.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func saveState(state *State) error {
+	path, err := statePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	data, err := yaml.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// recordDestinations moves destinations to the front of the recent list,
+// keeping it free of duplicates and capped at maxRecentDestinations.
+func recordDestinations(destinations ...string) {
+	if len(destinations) == 0 {
+		return
+	}
+
+	state, err := loadState()
+	if err != nil {
+		log.Printf("Warning: Failed to load state: %v", err)
+		return
+	}
+
+	recent := append([]string{}, destinations...)
+	for _, destination := range state.RecentDestinations {
+		if !containsString(recent, destination) {
+			recent = append(recent, destination)
+		}
+	}
+	if len(recent) > maxRecentDestinations {
+		recent = recent[:maxRecentDestinations]
+	}
+
+	// Skip the write when nothing changed, which is the common case on load
+	if strings.Join(recent, "\n") == strings.Join(state.RecentDestinations, "\n") {
+		return
+	}
+
+	state.RecentDestinations = recent
+	if err := saveState(state); err != nil {
+		log.Printf("Warning: Failed to save state: %v", err)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func saveConfig(config *Config) error {
+	configPath, err := configPath()
+	if err != nil {
+		return err
+	}
+
+	var updated yaml.Node
+	if err := updated.Encode(config); err != nil {
+		return &ConfigError{Kind: ConfigInvalid, Path: configPath, Err: err}
+	}
+
+	// Edit the existing document in place so hand-written comments survive
+	doc := &updated
+	if data, err := os.ReadFile(configPath); err == nil {
+		var existing yaml.Node
+		if yaml.Unmarshal(data, &existing) == nil && len(existing.Content) > 0 {
+			mergeYAMLNodes(existing.Content[0], &updated)
+			doc = &existing
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return &ConfigError{Kind: ConfigInvalid, Path: configPath, Err: err}
+	}
+	if err := encoder.Close(); err != nil {
+		return &ConfigError{Kind: ConfigInvalid, Path: configPath, Err: err}
+	}
+
+	// Write to a temporary file and rename it into place, so readers
+	// never see a half-written config. Rename the symlink target rather
+	// than replacing a symlinked config (e.g. from a dotfiles repo).
+	if target, err := filepath.EvalSymlinks(configPath); err == nil {
+		configPath = target
+	}
+	tmpPath := configPath + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0644); err != nil {
+		return configIOError(configPath, err)
+	}
+	if err := os.Rename(tmpPath, configPath); err != nil {
+		return configIOError(configPath, err)
+	}
+	return nil
+}
+
+// mergeYAMLNodes updates dst to hold the values of src while keeping dst's
+// comments and key order. Mapping keys missing from src are removed, and
+// sequence entries are matched by their "name" key so that comments follow
+// the tunnel they describe when tunnels are added, removed or reordered. An
+// entry whose name is gone, i.e. a renamed tunnel, matches by position.
+func mergeYAMLNodes(dst, src *yaml.Node) {
+	if dst.Kind != src.Kind {
+		head, line, foot := dst.HeadComment, dst.LineComment, dst.FootComment
+		*dst = *src
+		dst.HeadComment, dst.LineComment, dst.FootComment = head, line, foot
+		return
+	}
+
+	switch dst.Kind {
+	case yaml.ScalarNode:
+		if dst.Tag != src.Tag {
+			dst.Style = src.Style
+		}
+		dst.Tag = src.Tag
+		dst.Value = src.Value
+
+	case yaml.MappingNode:
+		var content []*yaml.Node
+		used := make(map[string]bool)
+		for i := 0; i+1 < len(dst.Content); i += 2 {
+			key := dst.Content[i].Value
+			if value := mappingValue(src, key); value != nil {
+				mergeYAMLNodes(dst.Content[i+1], value)
+				content = append(content, dst.Content[i], dst.Content[i+1])
+				used[key] = true
+			}
+		}
+		for i := 0; i+1 < len(src.Content); i += 2 {
+			if !used[src.Content[i].Value] {
+				content = append(content, src.Content[i], src.Content[i+1])
+			}
+		}
+		dst.Content = content
+
+	case yaml.SequenceNode:
+		var content []*yaml.Node
+		claimed := make(map[*yaml.Node]bool)
+		names := make(map[string]bool)
+		for _, entry := range src.Content {
+			if name := mappingValue(entry, "name"); name != nil {
+				names[name.Value] = true
+			}
+		}
+		for i, entry := range src.Content {
+			var match *yaml.Node
+			if name := mappingValue(entry, "name"); name != nil {
+				for _, candidate := range dst.Content {
+					if other := mappingValue(candidate, "name"); other != nil && other.Value == name.Value && !claimed[candidate] {
+						match = candidate
+						break
+					}
+				}
+				if match == nil && i < len(dst.Content) && !claimed[dst.Content[i]] {
+					if other := mappingValue(dst.Content[i], "name"); other != nil && !names[other.Value] {
+						match = dst.Content[i]
+					}
+				}
+			} else if i < len(dst.Content) && !claimed[dst.Content[i]] {
+				match = dst.Content[i]
+			}
+
+			if match == nil {
+				content = append(content, entry)
+				continue
+			}
+			claimed[match] = true
+			mergeYAMLNodes(match, entry)
+			content = append(content, match)
+		}
+		dst.Content = content
+
+	default:
+		*dst = *src
+	}
+}
+
+// mappingValue returns the value node for key in a mapping node, or nil.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func main() {
+	// Parse command line flags
+	debugFlag := flag.Bool("debug", false, "Enable debug mode (adds -v to sshuttle and -vvv to ssh)")
+	addFlag := flag.Bool("add", false, "Add new tunnel configuration")
+	sshFlag := flag.Bool("ssh", false, "Connect directly via SSH instead of creating tunnel")
+	sudoFlag := flag.Bool("sudo", false, "Run sshuttle through sudo, as if every tunnel set sudo: true (with -add: save sudo: true)")
+	watchFlag := flag.Bool("watch", false, "Reload the tunnel list every few seconds")
+	newWindowFlag := flag.Bool("new-window", false, "Run the selected tunnel in a new terminal window and keep the selector open")
+	readOnlyFlag := flag.Bool("readonly", false, "Don't allow changes to the config; tunnels can still be started and stopped")
+	detachFlag := flag.Bool("detach", false, "Start the selected tunnel detached from the terminal, logging to a file")
+	logFlag := flag.String("log", "", "Append tunnel starts and stops to this file instead of ~/.config/sshuttle-selector/activity.log")
+	noLogFlag := flag.Bool("no-log", false, "Don't write the activity log")
+	configFlag := flag.String("config", "", "Config file to use instead of ~/.config/sshuttle-selector/config.yaml; ~ and $VARS are expanded")
+	foregroundTailFlag := flag.Int("foreground-tail", 0, "Run the selected tunnel in the foreground, showing only the last N lines of its output")
+	nameFlag := flag.String("name", "", "Tunnel name (required with -add)")
+	hostFlag := flag.String("host", "", "SSH hostname (required with -add)")
+	userFlag := flag.String("user", "", "SSH username (required with -add)")
+	subnetsFlag := flag.String("subnets", "", "CIDR subnets to tunnel (required with -add)")
+	extraArgsFlag := flag.String("extra-args", "", "Additional sshuttle arguments (optional)")
+	subnetsFromFlag := flag.String("subnets-from", "", "File of CIDRs routed in addition to -subnets (optional)")
+	excludeFromFlag := flag.String("exclude-from", "", "File of subnets to exclude from the tunnel (optional)")
+	excludeFlag := flag.String("exclude", "", "CIDRs to exclude from the tunnel, comma-separated (optional)")
+	dnsFlag := flag.Bool("dns", false, "Also tunnel DNS requests (optional)")
+	nsHostsFlag := flag.String("ns-hosts", "", "Name server IPs to send tunneled DNS requests to, comma-separated (optional)")
+	methodFlag := flag.String("method", "", "sshuttle firewall method: auto, nat, nft, tproxy, pf, ipfw or windivert (optional)")
+	interactiveFlag := flag.Bool("interactive", false, "Tunnel needs interactive authentication such as 2FA and runs in the foreground (optional)")
+	ssmInstanceFlag := flag.String("ssm-instance", "", "Reach the host through an AWS SSM session to this instance ID (optional)")
+	proxyCommandFlag := flag.String("proxy-command", "", "SSH ProxyCommand used to reach the host, e.g. 'nc -X 5 -x proxy:1080 %h %p' (optional)")
+	cleanupFlag := flag.Bool("cleanup", false, "Remove firewall rules left behind by a crashed sshuttle")
+	genAliasesFlag := flag.String("gen-aliases", "", "Print a shell function per tunnel for bash or fish and exit")
+	genSystemdFlag := flag.Bool("gen-systemd", false, "Print a systemd user unit for the tunnel given by -name and exit")
+	genLaunchdFlag := flag.Bool("gen-launchd", false, "Print a launchd agent plist for the tunnel given by -name and exit")
+	superviseFlag := flag.Bool("supervise", false, "Keep the tunnel given by -name running, reconnecting when it drops")
+	initFlag := flag.Bool("init", false, "Write a commented config template and exit")
+	forceFlag := flag.Bool("force", false, "With -init, replace an existing config (it is backed up first)")
+	versionFlag := flag.Bool("version", false, "Print the version and exit")
+	checkUpdatesFlag := flag.Bool("check-updates", false, "Check update_url for a newer version and exit")
+	mergeFlag := flag.String("merge", "", "Add the tunnels of another config file to this one and exit")
+	onConflictFlag := flag.String("on-conflict", "skip", "With -merge, what to do with a tunnel whose name is taken: skip, rename or overwrite")
+	tidyFlag := flag.Bool("tidy", false, "Remove duplicate tunnels from the config, sort it by group and name and exit")
+	dumpCommandFlag := flag.Bool("dump-command", false, "Print the command the tunnel given by -name would run (honoring -debug and -ssh) and exit")
+	startFlag := flag.Bool("start", false, "Start the tunnel given by -name; -subnets overrides its subnets for this connection only")
+	groupFlag := flag.String("group", "", "Only list or connect tunnels in this group, \"other\" for ungrouped ones (with -add: the new tunnel's group)")
+	connectFlag := flag.String("connect", "", "Start the tunnel with this name or alias without opening the selector, like -start -name")
+	autoConnectFlag := flag.Bool("autoconnect", false, "Start all tunnels marked auto_connect and exit")
+	validateFlag := flag.Bool("validate", false, "Check the config for errors and exit")
+	testAllFlag := flag.Bool("test-all", false, "Check SSH connectivity to all configured tunnels in parallel and exit")
+	statusFlag := flag.Bool("status", false, "Print running tunnels with their uptime and exit")
+	stopFlag := flag.Bool("stop", false, "Stop all running tunnels and exit")
+	healthFlag := flag.Bool("health", false, "Check that traffic gets through every running tunnel and exit, non-zero if any is unhealthy")
+	countFlag := flag.Bool("count", false, "With -status, print only the number of running tunnels")
+	olderThanFlag := flag.Duration("older-than", 0, "With -status, only show tunnels up for longer than this (e.g. 1h)")
+	listFlag := flag.Bool("list", false, "Print configured tunnels and exit")
+	jsonFlag := flag.Bool("json", false, "With -list or -status, print JSON (see README for the schema)")
+	formatFlag := flag.String("format", "", "Output format for -list: table, json (same as -json) or a Go template such as '{{.Name}} {{.Host}}'")
+	clearHistoryFlag := flag.Bool("clear-history", false, "Forget recently used destinations and exit")
+	printActiveFlag := flag.Bool("print-active-command", false, "Print the full command line of each running tunnel and exit")
+
+	flag.Parse()
+
+	debugMode = *debugFlag
+	sshMode = *sshFlag
+	detachMode = *detachFlag
+	readOnlyMode = *readOnlyFlag
+	newWindowMode = *newWindowFlag
+	sudoMode = *sudoFlag
+	foregroundTail = *foregroundTailFlag
+	if *configFlag != "" {
+		configFile = expandPath(*configFlag)
+	}
+	if !*noLogFlag {
+		logPath := expandPath(*logFlag)
+		if logPath == "" {
+			if dir, err := configDir(); err == nil {
+				logPath = filepath.Join(dir, "activity.log")
+			}
+		}
+		if logPath != "" {
+			if err := openActivityLog(logPath); err != nil {
+				log.Printf("Warning: activity log disabled: %v", err)
+			}
+		}
+	}
+
+	// Handle CLI mode for adding configurations
+	if *addFlag {
+		newTunnel := TunnelConfig{
+			Name:         *nameFlag,
+			Host:         *hostFlag,
+			User:         *userFlag,
+			Subnets:      *subnetsFlag,
+			ExtraArgs:    ExtraArgs{Line: *extraArgsFlag},
+			ExcludeFrom:  *excludeFromFlag,
+			Exclude:      *excludeFlag,
+			DNS:          *dnsFlag,
+			NSHosts:      *nsHostsFlag,
+			ProxyCommand: *proxyCommandFlag,
+			SSMInstance:  *ssmInstanceFlag,
+			SubnetsFrom:  *subnetsFromFlag,
+			Interactive:  *interactiveFlag,
+			Sudo:         *sudoFlag,
+			Group:        *groupFlag,
+			Method:       *methodFlag,
+		}
+		if err := handleAddCommand(newTunnel); err != nil {
+			exitWithError(err)
+		}
+		fmt.Println("Tunnel configuration added successfully!")
+		os.Exit(0)
+	}
+
+	if *genAliasesFlag != "" {
+		if err := handleGenAliases(*genAliasesFlag); err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	if *genSystemdFlag {
+		if err := handleGenSystemd(*nameFlag); err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	if *genLaunchdFlag {
+		if err := handleGenLaunchd(*nameFlag); err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	if *superviseFlag {
+		if err := handleSuperviseCommand(*nameFlag); err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	if *versionFlag {
+		fmt.Println(version)
+		os.Exit(0)
+	}
+
+	if *checkUpdatesFlag {
+		if err := handleCheckUpdatesCommand(); err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	if *tidyFlag {
+		if err := handleTidyCommand(); err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	if *mergeFlag != "" {
+		if err := handleMergeCommand(*mergeFlag, *onConflictFlag); err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	if *initFlag {
+		if err := handleInitCommand(*forceFlag); err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	if *dumpCommandFlag {
+		config, err := loadOrCreateConfig()
+		if err == nil {
+			err = handleDumpCommand(config, *nameFlag)
+		}
+		if err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	if *startFlag || *connectFlag != "" {
+		name := *nameFlag
+		if *connectFlag != "" {
+			name = *connectFlag
+		}
+		config, err := loadOrCreateConfig()
+		if err == nil {
+			err = handleStartCommand(config, name, *subnetsFlag, *groupFlag)
+		}
+		if err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	if *autoConnectFlag {
+		if err := handleAutoConnectCommand(); err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	if *validateFlag {
+		if err := handleValidateCommand(); err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	if *testAllFlag {
+		if err := handleTestAllCommand(); err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	if *statusFlag {
+		if err := handleStatusCommand(*olderThanFlag, *countFlag, *jsonFlag); err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	if *stopFlag {
+		if err := handleStopCommand(); err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	if *healthFlag {
+		if err := handleHealthCommand(); err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	if *listFlag {
+		if err := handleListCommand(*formatFlag, *groupFlag, *jsonFlag); err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
 	}
-	if host == "" {
-		return fmt.Errorf("SSH hostname is required (use -host)")
+
+	if *clearHistoryFlag {
+		state, err := loadState()
+		if err == nil {
+			state.RecentDestinations = nil
+			err = saveState(state)
+		}
+		if err != nil {
+			exitWithError(err)
+		}
+		fmt.Println("Destination history cleared.")
+		os.Exit(0)
 	}
-	if user == "" {
-		return fmt.Errorf("SSH username is required (use -user)")
+
+	if *printActiveFlag {
+		tunnels, err := getActiveTunnels()
+		if err != nil {
+			exitWithError(err)
+		}
+		for _, tunnel := range tunnels {
+			fmt.Printf("%d\t%s\n", tunnel.PID, tunnel.Command)
+		}
+		os.Exit(0)
 	}
-	if subnets == "" {
-		return fmt.Errorf("subnets are required (use -subnets)")
+
+	if *cleanupFlag {
+		if err := handleCleanupCommand(); err != nil {
+			exitWithError(err)
+		}
+		fmt.Println("Firewall cleanup complete.")
+		os.Exit(0)
 	}
 
-	// Validate subnet format
-	if err := validateSubnets(subnets); err != nil {
-		return fmt.Errorf("invalid subnet format: %v", err)
+	// A config with problems would only half work, so the TUI doesn't
+	// start. Lesser problems are listed as warnings.
+	config, err := loadListConfig()
+	if err != nil {
+		exitWithError(err)
+	}
+	if err := validateConfig(config); err != nil {
+		path, _ := configPath()
+		exitWithError(&ConfigError{Kind: ConfigInvalid, Path: path, Err: fmt.Errorf("%s: %v", path, err)})
+	}
+	items, warnings := loadAllItems(config)
+	for _, warning := range configWarnings(config) {
+		if !containsString(warnings, warning) {
+			warnings = append(warnings, warning)
+		}
 	}
 
-	// Validate SSH connectivity (optional test)
-	if err := validateSSHConnection(user, host, extraArgs); err != nil {
-		fmt.Printf("Warning: SSH connectivity test failed: %v\n", err)
-		fmt.Print("Continue anyway? [y/N]: ")
-		var response string
-		fmt.Scanln(&response)
-		if strings.ToLower(response) != "y" && strings.ToLower(response) != "yes" {
-			return fmt.Errorf("operation cancelled")
+	const defaultList = 20
+	l := list.New(items, itemDelegate{}, defaultWidth, defaultList)
+	if sshMode {
+		l.Title = "SSH Connection Manager"
+	} else {
+		l.Title = "SSH Tunnel Manager"
+	}
+	l.SetShowStatusBar(false)
+	l.SetFilteringEnabled(true)
+	// Shown as "No matches." when a search matches nothing
+	l.SetStatusBarItemName("match", "matches")
+	l.SetShowHelp(false)
+	l.Styles.Title = titleStyle
+	// Navigation and quitting go through the configurable keybindings
+	l.KeyMap.CursorUp.SetEnabled(false)
+	l.KeyMap.CursorDown.SetEnabled(false)
+	l.KeyMap.Quit.SetEnabled(false)
+
+	// Find first selectable item and set it as selected
+	for i, listItem := range items {
+		if item, ok := listItem.(item); ok && isSelectableItem(item) {
+			l.Select(i)
+			break
 		}
 	}
 
-	// Load existing config or create new one
-	config, err := loadOrCreateConfig()
-	if err != nil {
-		return fmt.Errorf("failed to load config: %v", err)
+	// Leftover rules with nothing running mean sshuttle crashed. The items
+	// already list running tunnels, so ps isn't run a second time.
+	running := false
+	for _, listItem := range items {
+		if i, ok := listItem.(item); ok && i.itemType == ItemActiveTunnel {
+			running = true
+			break
+		}
+	}
+	if !running {
+		if rules, _ := staleFirewallRules(false); len(rules) > 0 {
+			warnings = append(warnings, "Stale sshuttle firewall rules detected, run with -cleanup to remove them")
+		}
 	}
 
-	// Check for duplicate names
-	for _, tunnel := range config.Tunnels {
-		if tunnel.Name == name {
-			return fmt.Errorf("tunnel with name '%s' already exists", name)
+	// sshuttle runs sudo itself for its firewall rules, so the selector
+	// doesn't need root. Say so once.
+	if os.Geteuid() == 0 {
+		if state, err := loadState(); err == nil && !state.RootWarningShown {
+			warnings = append(warnings, "Running as root is not needed: start the selector as your normal user and sshuttle will use sudo only for its firewall rules")
+			state.RootWarningShown = true
+			if err := saveState(state); err != nil {
+				log.Printf("Warning: failed to save state: %v", err)
+			}
 		}
 	}
 
-	// Add new tunnel
-	newTunnel := TunnelConfig{
-		Name:      name,
-		Host:      host,
-		User:      user,
-		Subnets:   subnets,
-		ExtraArgs: extraArgs,
+	m := model{list: l, warnings: warnings, latency: make(map[string]string)}
+	if state, err := loadState(); err == nil && state.VerboseActive {
+		m.verboseActive = true
+		m.list.SetDelegate(itemDelegate{verbose: true, latency: m.latency})
+	}
+	m.watch = *watchFlag
+	m.confirmQuit = config.ConfirmQuitWithActive
+	m.readOnly = configReadOnly()
+	m.terminalCmd = config.TerminalCmd
+	m.keys, err = resolveKeybindings(config.Keybindings)
+	if err != nil {
+		// configWarnings already said so
+		m.keys, _ = resolveKeybindings(nil)
+	}
+	for _, warning := range m.warnings {
+		m.logError(warning)
 	}
 
-	config.Tunnels = append(config.Tunnels, newTunnel)
+	p := tea.NewProgram(m, tea.WithAltScreen())
+	result, err := p.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Save config
-	if err := saveConfig(config); err != nil {
-		return fmt.Errorf("failed to save config: %v", err)
+	// Handle the selected action
+	if finalModel := result.(model); finalModel.choice != "" {
+		if strings.HasPrefix(finalModel.choice, "All tunnels killed") ||
+				  strings.HasPrefix(finalModel.choice, "Failed to kill") ||
+				  strings.HasPrefix(finalModel.choice, "Already connected") ||
+				  strings.HasPrefix(finalModel.choice, "Can't start") {
+			// Just print the status message
+			fmt.Println(finalModel.choice)
+		} else {
+			runChoice(config, finalModel.choice, finalModel.chosen)
+		}
+	}
+}
+
+// handleDumpCommand prints the command the tunnel given by name would run,
+// with its environment, without running it. Warnings go to stderr so stdout
+// can be pasted or piped as is.
+func handleDumpCommand(config *Config, name string) error {
+	tunnel, ok := findTunnel(config, name)
+	if !ok {
+		return fmt.Errorf("no tunnel named '%s'", name)
+	}
+
+	chosen, warnings := newTunnelItem(tunnel)
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
 	}
 
+	command := chosen.command
+	if len(tunnel.Env) > 0 {
+		var assignments []string
+		for _, entry := range envAssignments(tunnel.Env) {
+			assignments = append(assignments, shellQuote(entry))
+		}
+		command = "env " + strings.Join(assignments, " ") + " " + command
+	}
+	fmt.Println(command)
 	return nil
 }
 
-func validateSubnets(subnets string) error {
-	// Split by comma and validate each CIDR
-	subnetsSlice := strings.Split(subnets, ",")
-	for _, subnet := range subnetsSlice {
-		subnet = strings.TrimSpace(subnet)
-		if _, _, err := net.ParseCIDR(subnet); err != nil {
-			return fmt.Errorf("invalid CIDR '%s': %v", subnet, err)
+// handleStartCommand starts the configured tunnel name without the
+// selector, optionally routing subnets instead of the saved ones for this
+// connection only. The config is not modified.
+func handleStartCommand(config *Config, name, subnets, group string) error {
+	lookup := config
+	if group != "" {
+		lookup = &Config{Tunnels: tunnelsInGroup(config.Tunnels, group)}
+	}
+	tunnel, ok := findTunnel(lookup, name)
+	if !ok && group != "" {
+		return fmt.Errorf("no tunnel named '%s' in group '%s'", name, group)
+	}
+	if !ok {
+		return fmt.Errorf("no tunnel named '%s'", name)
+	}
+
+	chosen, warnings := newTunnelItem(tunnel)
+	if subnets != "" && !sshMode {
+		if err := validateSubnets(subnets); err != nil {
+			return fmt.Errorf("invalid subnet format: %v", err)
+		}
+		chosen, warnings = withSubnets(chosen, subnets)
+	}
+	for _, warning := range warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+
+	if !sshMode {
+		if isDestinationActive(chosen.destination) {
+			fmt.Printf("Already connected: %s\n", chosen.destination)
+			return nil
+		}
+		if !tunnel.Additive {
+			if err := killAllTunnels(); err != nil {
+				log.Printf("Warning: Failed to kill existing tunnels: %v", err)
+			}
+		}
+		if err := checkListenAvailable(tunnel.Listen); err != nil {
+			return fmt.Errorf("can't start %s: %v", tunnel.Name, err)
 		}
 	}
+
+	runChoice(config, chosen.command, chosen)
 	return nil
 }
 
-func validateSSHConnection(user, host, extraArgs string) error {
-	// Build SSH test command
-	sshArgs := []string{"-o", "ConnectTimeout=10", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=no"}
+// runChoice runs the command picked in the selector (or by -start) in the
+// foreground or detached, followed by the post_connect command. chosen is
+// the configured tunnel behind it, if any.
+func runChoice(config *Config, choice string, chosen item) {
+	if chosen.routesAll {
+		fmt.Println(allTrafficWarning(chosen.destination))
+	}
+	if !chosen.isSSHDirect && chosen.tunnel.Host != "" {
+		subnets, _ := tunnelSubnets(chosen.tunnel)
+		for _, warning := range hostRoutedWarnings(chosen.tunnel.Host, subnets) {
+			fmt.Printf("Warning: %s\n", warning)
+		}
+		if chosen.tunnel.Additive {
+			if running, err := getActiveTunnels(); err == nil {
+				for _, warning := range overlapWarnings(chosen.tunnel.Name, subnets, running) {
+					fmt.Printf("Warning: %s\n", warning)
+				}
+			}
+		}
+	}
 
-	// Parse extra args for SSH key
-	if strings.Contains(extraArgs, "-i ") {
-		keyPath := strings.TrimSpace(strings.Split(extraArgs, "-i ")[1])
-		keyPath = strings.Split(keyPath, " ")[0] // Take only the key path
-		sshArgs = append(sshArgs, "-i", keyPath)
+	destination := chosen.destination
+	if destination == "" {
+		if tunnel, err := parseSshuttleCommand(choice); err == nil {
+			destination = fmt.Sprintf("%s@%s", tunnel.User, tunnel.Host)
+		}
+	}
+	if destination != "" {
+		recordDestinations(destination)
 	}
 
-	// Add user@host
-	sshArgs = append(sshArgs, fmt.Sprintf("%s@%s", user, host), "exit")
+	if newWindowMode {
+		err := startInNewWindow(config.TerminalCmd, choice, chosen.tunnel.Env)
+		if err == nil {
+			logActivity("start", chosen.tunnel.Name, destination, 0, "new window")
+			fmt.Println("Started in a new terminal window")
+			return
+		}
+		fmt.Printf("Warning: %v, running in this terminal\n", err)
+	}
 
-	// Test SSH connection
-	cmd := exec.Command("ssh", sshArgs...)
-	return cmd.Run()
-}
+	if detachMode && !strings.HasPrefix(choice, "ssh ") {
+		if strings.HasPrefix(choice, "sudo ") {
+			// The detached tunnel has no terminal to prompt on
+			refreshSudo()
+		}
+		existing, _ := tunnelPIDs(destination)
+		pid, logPath, err := startDetached(choice, chosen.tunnel.Env)
+		if err != nil {
+			logActivity("start", chosen.tunnel.Name, destination, 0, err.Error())
+			fmt.Printf("Error starting detached tunnel: %v\n", err)
+			os.Exit(1)
+		}
+		// The launcher's PID is known at once, but sshuttle may still fail
+		if destination != "" {
+			if pid = waitForTunnel(destination, existing); pid == 0 {
+				logActivity("start", chosen.tunnel.Name, destination, 0, "not running")
+				fmt.Printf("Tunnel to %s did not come up, see its output in %s\n", destination, logPath)
+				os.Exit(1)
+			}
+		}
+		logActivity("start", chosen.tunnel.Name, destination, pid, "detached")
+		fmt.Printf("Tunnel detached (PID: %d), logging to %s\n", pid, logPath)
+		fmt.Printf("Stop it with: kill %d\n", pid)
+		runProbe(chosen.tunnel)
+		runPostConnect(config.PostConnect, chosen)
+		runTunnelPostConnect(chosen)
+		return
+	}
 
-func loadOrCreateConfig() (*Config, error) {
-	homeDir, err := os.UserHomeDir()
+	if foregroundTail > 0 && !strings.HasPrefix(choice, "ssh ") && !strings.Contains(choice, "--daemon") && !chosen.tunnel.Interactive {
+		logActivity("start", chosen.tunnel.Name, destination, 0, "foreground")
+		err := runTailed(choice, chosen.tunnel.Env, foregroundTail)
+		logActivity("exit", chosen.tunnel.Name, destination, 0, exitStatus(err))
+		if err != nil {
+			fmt.Printf("Tunnel exited: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Check if it's an SSH direct connection or tunnel
+	if strings.HasPrefix(choice, "ssh ") {
+		fmt.Printf("Connecting via SSH...\n")
+	} else {
+		fmt.Printf("Starting tunnel...\n")
+	}
+
+	// Use shell to execute the command properly
+	cmd := exec.Command("sh", "-c", choice)
+	cmd.Env = tunnelEnv(chosen.tunnel.Env)
+	var stderr tailBuffer
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	cmd.Stdin = os.Stdin
+
+	daemon := !strings.HasPrefix(choice, "ssh ") && strings.Contains(choice, "--daemon")
+	var existing []int
+	if daemon && destination != "" {
+		existing, _ = tunnelPIDs(destination)
+	}
+	if !daemon && !strings.HasPrefix(choice, "ssh ") {
+		logActivity("start", chosen.tunnel.Name, destination, 0, "foreground")
+	}
+	err := cmd.Run()
+	switch {
+	case strings.HasPrefix(choice, "ssh "):
+	case daemon && err != nil:
+		logActivity("start", chosen.tunnel.Name, destination, 0, exitStatus(err))
+	case !daemon:
+		logActivity("exit", chosen.tunnel.Name, destination, 0, exitStatus(err))
+	}
 	if err != nil {
-		return nil, err
+		fmt.Printf("Error executing command: %v\n", err)
+		if hint := sshuttleErrorHint(stderr.String()); hint != "" {
+			fmt.Println(hint)
+		}
+		os.Exit(1)
 	}
 
-	configPath := filepath.Join(homeDir, ".config", "sshuttle-selector", "config.yaml")
+	if !daemon {
+		return
+	}
 
-	// Create directory if it doesn't exist
-	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
-		return nil, err
+	// A daemonized tunnel should be up once sshuttle returns; foreground
+	// tunnels only return after they've stopped. Check that it really is.
+	if destination != "" {
+		pid := waitForTunnel(destination, existing)
+		if pid == 0 {
+			logActivity("start", chosen.tunnel.Name, destination, 0, "not running")
+			fmt.Printf("Tunnel to %s did not come up\n", destination)
+			if output := strings.TrimSpace(stderr.String()); output != "" {
+				fmt.Printf("sshuttle output:\n%s\n", output)
+			}
+			if hint := sshuttleErrorHint(stderr.String()); hint != "" {
+				fmt.Println(hint)
+			}
+			os.Exit(1)
+		}
+		logActivity("start", chosen.tunnel.Name, destination, pid, "ok")
+		fmt.Printf("Tunnel to %s is up (PID: %d)\n", destination, pid)
 	}
+	runProbe(chosen.tunnel)
+	runPostConnect(config.PostConnect, chosen)
+	runTunnelPostConnect(chosen)
+}
 
-	// Check if config file exists
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		// Return empty config
-		return &Config{Tunnels: []TunnelConfig{}}, nil
+// tailLineMsg is a line of output of the command run by runTailed.
+type tailLineMsg string
+
+// tailDoneMsg reports that the command run by runTailed exited.
+type tailDoneMsg struct{ err error }
+
+// tailModel shows the last lines of a running tunnel's output in a fixed
+// region that is redrawn in place.
+type tailModel struct {
+	process  *os.Process
+	size     int
+	lines    []string
+	output   <-chan string
+	exited   <-chan error
+	err      error
+	done     bool
+	stopping bool
+	width    int
+}
+
+func (m tailModel) Init() tea.Cmd {
+	return m.nextLine()
+}
+
+// nextLine waits for the next output line, or for the exit once the output
+// is closed.
+func (m tailModel) nextLine() tea.Cmd {
+	return func() tea.Msg {
+		if line, ok := <-m.output; ok {
+			return tailLineMsg(line)
+		}
+		return tailDoneMsg{err: <-m.exited}
 	}
+}
 
-	// Load existing config
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		return nil, err
+func (m tailModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+	case tailLineMsg:
+		m.lines = append(m.lines, string(msg))
+		if len(m.lines) > m.size {
+			m.lines = m.lines[len(m.lines)-m.size:]
+		}
+		return m, m.nextLine()
+	case tailDoneMsg:
+		m.done = true
+		m.err = msg.err
+		return m, tea.Quit
+	case tea.KeyMsg:
+		if msg.String() == "ctrl+c" {
+			// sshuttle removes its firewall rules on SIGINT; a second
+			// Ctrl+C kills it outright
+			if m.stopping || m.process.Signal(os.Interrupt) != nil {
+				m.process.Kill()
+			}
+			m.stopping = true
+		}
 	}
+	return m, nil
+}
 
-	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, err
+func (m tailModel) View() string {
+	status := "ctrl+c stop"
+	if m.stopping {
+		status = "stopping..."
+	}
+	if m.done {
+		status = "exited"
+	}
+	view := titleStyle.UnsetMarginBottom().Render(fmt.Sprintf("sshuttle output, last %d lines", m.size)) + " " + statusStyle.Render(status) + "\n"
+	for i := 0; i < m.size; i++ {
+		line := ""
+		if i < len(m.lines) {
+			line = m.lines[i]
+			if m.width > 2 {
+				line = ansi.Truncate(line, m.width-2, "…")
+			}
+		}
+		view += "  " + line + "\n"
 	}
+	return view
+}
 
-	return &config, nil
+// refreshSudo asks for the sudo password now, while the terminal is ours,
+// so that sudo calls of a tunnel that can't prompt don't fail.
+func refreshSudo() {
+	if os.Geteuid() > 0 {
+		sudo := exec.Command("sudo", "-v")
+		sudo.Stdin, sudo.Stdout, sudo.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := sudo.Run(); err != nil {
+			fmt.Printf("Warning: sudo -v failed: %v\n", err)
+		}
+	}
 }
 
-func saveConfig(config *Config) error {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
+// runTailed runs command in the foreground with its output shown in a
+// region of size lines that updates in place, until it exits or Ctrl+C
+// stops it. sudo credentials are refreshed first, as its password prompt
+// can't be answered inside the region.
+func runTailed(command string, env map[string]string, size int) error {
+	refreshSudo()
+
+	// exec so that Ctrl+C signals sshuttle itself rather than sh
+	cmd := exec.Command("sh", "-c", "exec "+command)
+	cmd.Env = tunnelEnv(env)
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	if err := cmd.Start(); err != nil {
 		return err
 	}
 
-	configPath := filepath.Join(homeDir, ".config", "sshuttle-selector", "config.yaml")
+	output := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			output <- scanner.Text()
+		}
+		close(output)
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		writer.Close()
+		exited <- err
+	}()
 
-	// Marshal to YAML
-	data, err := yaml.Marshal(config)
+	m := tailModel{process: cmd.Process, size: size, output: output, exited: exited}
+	result, err := tea.NewProgram(m).Run()
 	if err != nil {
+		cmd.Process.Kill()
 		return err
 	}
-
-	// Write to file
-	return os.WriteFile(configPath, data, 0644)
+	final := result.(tailModel)
+	if final.stopping {
+		// Stopped on purpose
+		return nil
+	}
+	if hint := sshuttleErrorHint(strings.Join(final.lines, "\n")); final.err != nil && hint != "" {
+		return fmt.Errorf("%v. %s", final.err, hint)
+	}
+	return final.err
 }
 
-func main() {
-	// Parse command line flags
-	debugFlag := flag.Bool("debug", false, "Enable debug mode (adds -v to sshuttle and -vvv to ssh)")
-	addFlag := flag.Bool("add", false, "Add new tunnel configuration")
-	sshFlag := flag.Bool("ssh", false, "Connect directly via SSH instead of creating tunnel")
-	nameFlag := flag.String("name", "", "Tunnel name (required with -add)")
-	hostFlag := flag.String("host", "", "SSH hostname (required with -add)")
-	userFlag := flag.String("user", "", "SSH username (required with -add)")
-	subnetsFlag := flag.String("subnets", "", "CIDR subnets to tunnel (required with -add)")
-	extraArgsFlag := flag.String("extra-args", "", "Additional sshuttle arguments (optional)")
-
-	flag.Parse()
+// terminalLaunchers are tried in order when terminal_cmd isn't set. Each
+// runs the shell command given as its last argument in a new window.
+var terminalLaunchers = [][]string{
+	{"gnome-terminal", "--", "sh", "-c"},
+	{"konsole", "-e", "sh", "-c"},
+	{"xfce4-terminal", "-x", "sh", "-c"},
+	{"alacritty", "-e", "sh", "-c"},
+	{"kitty", "sh", "-c"},
+	{"xterm", "-e", "sh", "-c"},
+}
 
-	debugMode = *debugFlag
-	sshMode = *sshFlag
+// startInNewWindow runs command with env in a new terminal window without
+// waiting for it. The window stays open after the command exits so its
+// output can be read.
+func startInNewWindow(terminalCmd, command string, env map[string]string) error {
+	// The terminal may not be our child (gnome-terminal, Terminal.app), so
+	// the environment goes into the script itself
+	var script strings.Builder
+	for _, assignment := range envAssignments(env) {
+		key, value, _ := strings.Cut(assignment, "=")
+		fmt.Fprintf(&script, "export %s=%s; ", key, shellQuote(value))
+	}
+	script.WriteString(command)
+	script.WriteString("; printf '\\nPress enter to close'; read _")
 
-	// Handle CLI mode for adding configurations
-	if *addFlag {
-		if err := handleAddCommand(*nameFlag, *hostFlag, *userFlag, *subnetsFlag, *extraArgsFlag); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+	var cmd *exec.Cmd
+	switch {
+	case terminalCmd != "":
+		args, err := splitArgs(terminalCmd)
+		if err != nil || len(args) == 0 {
+			return fmt.Errorf("invalid terminal_cmd '%s'", terminalCmd)
+		}
+		cmd = exec.Command(args[0], append(args[1:], script.String())...)
+	case runtime.GOOS == "darwin" && os.Getenv("TERM_PROGRAM") == "iTerm.app":
+		cmd = exec.Command("osascript",
+			"-e", `tell application "iTerm"`,
+			"-e", "create window with default profile",
+			"-e", "tell current session of current window to write text "+appleScriptQuote(script.String()),
+			"-e", "end tell")
+	case runtime.GOOS == "darwin":
+		cmd = exec.Command("osascript", "-e", `tell application "Terminal" to do script `+appleScriptQuote(script.String()))
+	default:
+		for _, launcher := range terminalLaunchers {
+			if _, err := exec.LookPath(launcher[0]); err == nil {
+				cmd = exec.Command(launcher[0], append(launcher[1:], script.String())...)
+				break
+			}
+		}
+		if cmd == nil {
+			return fmt.Errorf("no terminal emulator found (set terminal_cmd)")
 		}
-		fmt.Println("Tunnel configuration added successfully!")
-		os.Exit(0)
 	}
 
-	items, err := loadAllItems()
-	if err != nil {
-		log.Printf("Error loading items: %v", err)
-		log.Fatal("Failed to load configuration")
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to open a terminal window: %v", err)
 	}
+	// Don't leave a zombie behind while the selector keeps running
+	go cmd.Wait()
+	return nil
+}
 
-	const defaultList = 20
-	l := list.New(items, itemDelegate{}, defaultWidth, defaultList)
-	if sshMode {
-		l.Title = "SSH Connection Manager"
-	} else {
-		l.Title = "SSH Tunnel Manager"
+// appleScriptQuote quotes s as an AppleScript string literal.
+func appleScriptQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// runProbe reverse-resolves the tunnel's probe_address through the new
+// tunnel and reports which network it reached, or a mismatch with
+// probe_expect.
+func runProbe(tunnel TunnelConfig) {
+	if tunnel.ProbeAddress == "" {
+		return
 	}
-	l.SetShowStatusBar(false)
-	l.SetFilteringEnabled(true)
-	l.SetShowHelp(false)
-	l.Styles.Title = titleStyle
 
-	// Find first selectable item and set it as selected
-	for i, listItem := range items {
-		if item, ok := listItem.(item); ok && isSelectableItem(item) {
-			l.Select(i)
-			break
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	names, err := net.DefaultResolver.LookupAddr(ctx, tunnel.ProbeAddress)
+	if err != nil || len(names) == 0 {
+		fmt.Printf("Warning: can't confirm the network, reverse lookup of %s failed: %v\n", tunnel.ProbeAddress, err)
+		return
+	}
+
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		if strings.Contains(strings.ToLower(name), strings.ToLower(tunnel.ProbeExpect)) {
+			fmt.Printf("Connected to %s (%s is %s)\n", tunnel.Name, tunnel.ProbeAddress, name)
+			return
 		}
 	}
+	fmt.Printf("Warning: %s is %s, expected a name containing '%s'. Is this the right network?\n",
+		tunnel.ProbeAddress, strings.TrimSuffix(names[0], "."), tunnel.ProbeExpect)
+}
 
-	m := model{list: l}
+// validateProbe checks that probe_address is an IP the tunnel routes.
+func validateProbe(tunnel TunnelConfig) error {
+	if tunnel.ProbeAddress == "" {
+		if tunnel.ProbeExpect != "" {
+			return fmt.Errorf("probe_expect needs probe_address")
+		}
+		return nil
+	}
+	ip := net.ParseIP(tunnel.ProbeAddress)
+	if ip == nil {
+		return fmt.Errorf("probe_address '%s' is not an IP address", tunnel.ProbeAddress)
+	}
+	subnets, _ := tunnelSubnets(tunnel)
+	for _, network := range parseSubnetList(subnets) {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("probe_address %s is outside the tunneled subnets", tunnel.ProbeAddress)
+}
 
-	p := tea.NewProgram(m, tea.WithAltScreen())
-	result, err := p.Run()
-	if err != nil {
-		log.Fatal(err)
+// runPostConnect runs the global post_connect command after a tunnel has
+// started. Failures are reported but never fatal, since the tunnel is up.
+func runPostConnect(command string, chosen item) {
+	if command == "" {
+		return
 	}
 
-	// Handle the selected action
-	if finalModel := result.(model); finalModel.choice != "" {
-		if finalModel.choice == "add_new_tunnel" {
-			fmt.Println("Coming soon: Interactive tunnel creation")
-		} else if strings.HasPrefix(finalModel.choice, "Tunnel stopped:") ||
-				  strings.HasPrefix(finalModel.choice, "Failed to stop") ||
-				  strings.HasPrefix(finalModel.choice, "All tunnels killed") ||
-				  strings.HasPrefix(finalModel.choice, "Failed to kill") {
-			// Just print the status message
-			fmt.Println(finalModel.choice)
-		} else {
-			// Check if it's an SSH direct connection or tunnel
-			if strings.HasPrefix(finalModel.choice, "ssh ") {
-				fmt.Printf("Connecting via SSH...\n")
-			} else {
-				fmt.Printf("Starting tunnel...\n")
-			}
+	ctx, cancel := context.WithTimeout(context.Background(), postConnectTimeout)
+	defer cancel()
 
-			// Use shell to execute the command properly
-			cmd := exec.Command("sh", "-c", finalModel.choice)
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			cmd.Stdin = os.Stdin
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"SSHUTTLE_SELECTOR_TUNNEL="+chosen.tunnel.Name,
+		"SSHUTTLE_SELECTOR_DESTINATION="+chosen.destination)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
 
-			if err := cmd.Run(); err != nil {
-				fmt.Printf("Error executing command: %v\n", err)
-				os.Exit(1)
-			}
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", postConnectTimeout)
 		}
+		log.Printf("Warning: post_connect command failed: %v", err)
 	}
-}
\ No newline at end of file
+}
+
+// runTunnelPostConnect runs the tunnel's own post_connect command once it
+// is up. Unlike the global one it gets the terminal and has no time limit,
+// since it is usually a tool that needs the tunnel.
+func runTunnelPostConnect(chosen item) {
+	command := chosen.tunnel.PostConnect
+	if command == "" {
+		return
+	}
+
+	fmt.Printf("Running %s\n", command)
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), envAssignments(chosen.tunnel.Env)...)
+	cmd.Env = append(cmd.Env,
+		"SSHUTTLE_SELECTOR_TUNNEL="+chosen.tunnel.Name,
+		"SSHUTTLE_SELECTOR_DESTINATION="+chosen.destination)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("Warning: post_connect of %s failed: %v\n", chosen.tunnel.Name, err)
+	}
+}
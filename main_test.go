@@ -0,0 +1,885 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/bubbles/list"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// writeProc builds a fake /proc tree under a temporary directory, with a
+// cmdline file per PID holding the NUL-separated argv.
+func writeProc(t *testing.T, cmdlines map[int][]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for pid, argv := range cmdlines {
+		dir := filepath.Join(root, strconv.Itoa(pid))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		data := ""
+		if len(argv) > 0 {
+			data = strings.Join(argv, "\x00") + "\x00"
+		}
+		if err := os.WriteFile(filepath.Join(dir, "cmdline"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Not a process
+	if err := os.MkdirAll(filepath.Join(root, "self"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+var fakeProcesses = map[int][]string{
+	101: {"/usr/bin/sshuttle", "-r", "ubuntu@prod.example.com", "10.0.0.0/8", "--daemon"},
+	102: {"/usr/bin/python3", "/usr/bin/sshuttle", "-r", "admin@stage.example.com", "10.2.0.0/16"},
+	103: {"sh", "/usr/local/bin/sshuttle", "-r", "me@wrapped.example.com", "10.3.0.0/16"},
+	104: {"/usr/bin/python3", "/usr/bin/sshuttle", "--firewall", "12300", "0"},
+	105: {"sudo", "sshuttle", "-r", "root@sudo.example.com", "10.5.0.0/16"},
+	106: {"sh", "-c", "sshuttle -r ubuntu@prod.example.com 10.0.0.0/8"},
+	107: {"grep", "sshuttle"},
+	108: {"/usr/bin/python3", "-u", "/usr/bin/sshuttle", "-r", "u@spaced.example.com", "-e", "ssh -i /keys/my key", "10.8.0.0/16"},
+	109: nil, // kernel thread
+}
+
+func TestProcProcesses(t *testing.T) {
+	root := writeProc(t, fakeProcesses)
+
+	processes, err := procProcesses(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[int][]string)
+	for _, p := range processes {
+		got[p.PID] = p.Argv
+	}
+
+	want := make(map[int][]string)
+	for pid, argv := range fakeProcesses {
+		if argv != nil {
+			want[pid] = argv
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("procProcesses() = %v, want %v", got, want)
+	}
+}
+
+func TestProcProcessesMissingRoot(t *testing.T) {
+	if _, err := procProcesses(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("procProcesses() of a missing root succeeded")
+	}
+}
+
+func TestRunsSshuttle(t *testing.T) {
+	tests := []struct {
+		argv []string
+		want bool
+	}{
+		{[]string{"sshuttle", "-r", "u@h", "10.0.0.0/8"}, true},
+		{[]string{"/usr/bin/python3.11", "/usr/bin/sshuttle", "-r", "u@h"}, true},
+		{[]string{"python3", "-m", "sshuttle", "-r", "u@h"}, true},
+		{[]string{"bash", "/opt/bin/sshuttle", "-r", "u@h"}, true},
+		{[]string{"sh", "-c", "sshuttle -r u@h 10.0.0.0/8"}, false},
+		{[]string{"sudo", "sshuttle", "-r", "u@h"}, false},
+		{[]string{"vim", "sshuttle"}, false},
+		{[]string{"python3", "script.py", "sshuttle"}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := runsSshuttle(tt.argv); got != tt.want {
+			t.Errorf("runsSshuttle(%q) = %v, want %v", tt.argv, got, tt.want)
+		}
+	}
+}
+
+func TestGetActiveTunnels(t *testing.T) {
+	root := writeProc(t, fakeProcesses)
+	saved := listProcesses
+	defer func() { listProcesses = saved }()
+	listProcesses = func() ([]process, error) {
+		return procProcesses(root)
+	}
+
+	tunnels, err := getActiveTunnels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(tunnels, func(a, b int) bool { return tunnels[a].PID < tunnels[b].PID })
+
+	want := []struct {
+		pid         int
+		destination string
+		subnets     []string
+		sshCmd      string
+	}{
+		{101, "ubuntu@prod.example.com", []string{"10.0.0.0/8"}, ""},
+		{102, "admin@stage.example.com", []string{"10.2.0.0/16"}, ""},
+		{103, "me@wrapped.example.com", []string{"10.3.0.0/16"}, ""},
+		{108, "u@spaced.example.com", []string{"10.8.0.0/16"}, "ssh -i /keys/my key"},
+	}
+	if len(tunnels) != len(want) {
+		t.Fatalf("getActiveTunnels() found %d tunnels, want %d: %+v", len(tunnels), len(want), tunnels)
+	}
+	for i, w := range want {
+		got := tunnels[i]
+		if got.PID != w.pid || got.Destination != w.destination || !reflect.DeepEqual(got.Args.Subnets, w.subnets) || got.Args.SSHCmd != w.sshCmd {
+			t.Errorf("tunnel %d = %d %s %v %q, want %d %s %v %q", i, got.PID, got.Destination, got.Args.Subnets, got.Args.SSHCmd, w.pid, w.destination, w.subnets, w.sshCmd)
+		}
+	}
+}
+
+func TestGetActiveTunnelsNone(t *testing.T) {
+	saved := listProcesses
+	defer func() { listProcesses = saved }()
+	listProcesses = func() ([]process, error) {
+		return []process{{PID: 1, Argv: []string{"init"}}}, nil
+	}
+
+	tunnels, err := getActiveTunnels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnels == nil || len(tunnels) != 0 {
+		t.Errorf("getActiveTunnels() = %#v, want an empty slice", tunnels)
+	}
+}
+
+func TestWaitForTunnel(t *testing.T) {
+	saved := listProcesses
+	defer func() { listProcesses = saved }()
+	listProcesses = func() ([]process, error) {
+		return []process{
+			{PID: 300, Argv: []string{"python3", "/usr/bin/sshuttle", "-r", "ubuntu@prod.example.com", "10.3.0.0/16"}},
+			{PID: 200, Argv: []string{"python3", "/usr/bin/sshuttle", "-r", "ubuntu@prod.example.com", "10.2.0.0/16"}},
+			{PID: 100, Argv: []string{"python3", "/usr/bin/sshuttle", "-r", "admin@stage.example.com", "10.1.0.0/16"}},
+		}, nil
+	}
+
+	// The additive tunnel already running to the destination is passed over
+	if pid := waitForTunnel("ubuntu@prod.example.com", []int{200}); pid != 300 {
+		t.Errorf("waitForTunnel() = %d, want 300", pid)
+	}
+	if pid := waitForTunnel("ubuntu@prod.example.com", nil); pid != 200 {
+		t.Errorf("waitForTunnel() without running tunnels = %d, want 200", pid)
+	}
+}
+
+// multiSubnetProcess is a running tunnel whose subnets were passed to
+// sshuttle as one comma-joined argument.
+var multiSubnetProcess = process{PID: 400, Argv: []string{"/usr/bin/python3", "/usr/bin/sshuttle", "-r", "ubuntu@prod.example.com", "10.0.0.0/8,172.16.0.0/12", "--daemon"}}
+
+// stubProcesses makes getActiveTunnels see processes for the rest of the
+// test.
+func stubProcesses(t *testing.T, processes ...process) {
+	saved := listProcesses
+	t.Cleanup(func() { listProcesses = saved })
+	listProcesses = func() ([]process, error) {
+		return processes, nil
+	}
+}
+
+func TestHealthTargetMultiSubnet(t *testing.T) {
+	stubProcesses(t, multiSubnetProcess)
+	tunnels, err := getActiveTunnels()
+	if err != nil || len(tunnels) != 1 {
+		t.Fatalf("getActiveTunnels() = %+v, %v", tunnels, err)
+	}
+
+	if target := healthTarget(tunnels[0], nil); target != "10.0.0.1:22" {
+		t.Errorf("healthTarget() = %q, want 10.0.0.1:22", target)
+	}
+}
+
+func TestOverlapWarningsMultiSubnet(t *testing.T) {
+	stubProcesses(t, multiSubnetProcess)
+	running, err := getActiveTunnels()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The overlap is with the second subnet of the running tunnel
+	if warnings := overlapWarnings("stage", "172.16.5.0/24", running); len(warnings) != 1 {
+		t.Errorf("overlapWarnings() = %q, want one warning", warnings)
+	}
+	if warnings := overlapWarnings("stage", "192.168.0.0/16", running); len(warnings) != 0 {
+		t.Errorf("overlapWarnings() without overlap = %q", warnings)
+	}
+}
+
+func TestActiveTunnelDetailsMultiSubnet(t *testing.T) {
+	stubProcesses(t, multiSubnetProcess)
+	running, err := getActiveTunnels()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "[10.0.0.0/8,172.16.0.0/12 • daemon]"
+	if got := activeTunnelDetails(running[0], ""); got != want {
+		t.Errorf("activeTunnelDetails() = %q, want %q", got, want)
+	}
+}
+
+// captureStdout returns what f printed to stdout.
+func captureStdout(t *testing.T, f func() error) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	output := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- data
+	}()
+	err = f()
+	os.Stdout = saved
+	w.Close()
+	data := <-output
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestStatusJSONMultiSubnet(t *testing.T) {
+	stubProcesses(t, multiSubnetProcess)
+
+	var status StatusJSON
+	output := captureStdout(t, func() error { return handleStatusCommand(0, false, true) })
+	if err := json.Unmarshal([]byte(output), &status); err != nil {
+		t.Fatalf("-status -json printed %q: %v", output, err)
+	}
+	if len(status.Tunnels) != 1 {
+		t.Fatalf("-status -json listed %d tunnels, want 1", len(status.Tunnels))
+	}
+	want := []string{"10.0.0.0/8", "172.16.0.0/12"}
+	if got := status.Tunnels[0].Subnets; !reflect.DeepEqual(got, want) {
+		t.Errorf("subnets = %q, want %q", got, want)
+	}
+}
+
+func TestAutoConnectSkipsOverlapWithMultiSubnet(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dir := filepath.Join(home, ".config", "sshuttle-selector")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	config := "tunnels:\n  - name: stage\n    user: admin\n    host: stage.example.com\n    subnets: 172.16.5.0/24\n    auto_connect: true\n"
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stubProcesses(t, multiSubnetProcess)
+
+	// Nothing is started: the running tunnel routes 172.16.0.0/12 too
+	output := captureStdout(t, handleAutoConnectCommand)
+	if !strings.Contains(output, "subnets overlap with ubuntu@prod.example.com") {
+		t.Errorf("-autoconnect printed %q, want stage skipped for the overlap", output)
+	}
+}
+
+func TestGenAliasesStop(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	output := captureStdout(t, func() error { return handleGenAliases("bash") })
+	if strings.Contains(output, "pkill") || !strings.Contains(output, " -stop\n}") {
+		t.Errorf("vpn_stop doesn't go through -stop:\n%s", output)
+	}
+}
+
+// writeConfig writes config.yaml with data under a new home directory and
+// returns its path.
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dir := filepath.Join(home, ".config", "sshuttle-selector")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTidyUnchanged(t *testing.T) {
+	// Not formatted the way saveConfig writes it
+	data := "tunnels:\n- {name: alpha, user: u, host: a.example.com, subnets: 10.1.0.0/16}\n- {name: beta, user: u, host: b.example.com, subnets: 10.2.0.0/16}\n"
+	path := writeConfig(t, data)
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(path, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	output := captureStdout(t, handleTidyCommand)
+	if !strings.Contains(output, "already tidy") {
+		t.Errorf("-tidy printed %q", output)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != data || !info.ModTime().Equal(past) {
+		t.Errorf("-tidy rewrote a tidy config:\n%s", got)
+	}
+	if _, err := os.Stat(path + ".bak"); err == nil {
+		t.Error("-tidy backed up a tidy config")
+	}
+}
+
+func TestTidyGroups(t *testing.T) {
+	writeConfig(t, `tunnels:
+  - {name: alpha, user: u, host: a.example.com, subnets: 10.1.0.0/16}
+  - {name: delta, user: u, host: d.example.com, subnets: 10.4.0.0/16, group: prod}
+  - {name: beta, user: u, host: b.example.com, subnets: 10.2.0.0/16, group: Dev}
+  - {name: charlie, user: u, host: c.example.com, subnets: 10.3.0.0/16, group: prod}
+  - {name: echo, user: u, host: e.example.com, subnets: 10.5.0.0/16, group: dev}
+`)
+
+	output := captureStdout(t, handleTidyCommand)
+	if !strings.Contains(output, "sorted tunnels by group and name") {
+		t.Errorf("-tidy printed %q", output)
+	}
+	config, err := loadOrCreateConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, tunnel := range config.Tunnels {
+		names = append(names, tunnel.Name)
+	}
+	// Ungrouped tunnels come last, as in the list
+	want := []string{"beta", "echo", "charlie", "delta", "alpha"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("tidied order = %q, want %q", names, want)
+	}
+
+	if output := captureStdout(t, handleTidyCommand); !strings.Contains(output, "already tidy") {
+		t.Errorf("second -tidy printed %q", output)
+	}
+}
+
+// procSession returns the session ID field of a /proc stat line.
+func procSession(t *testing.T, stat string) string {
+	t.Helper()
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 4 {
+		t.Fatalf("unexpected stat format %q", stat)
+	}
+	return fields[3]
+}
+
+func TestStartDetachedNewSession(t *testing.T) {
+	own, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		t.Skip("needs /proc")
+	}
+	t.Setenv("HOME", t.TempDir())
+	out := filepath.Join(t.TempDir(), "stat")
+
+	if _, _, err := startDetached("cat /proc/self/stat > "+shellQuote(out)+".tmp && mv "+shellQuote(out)+".tmp "+shellQuote(out), nil); err != nil {
+		t.Fatal(err)
+	}
+	var stat []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if stat, err = os.ReadFile(out); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("detached command didn't run: %v", err)
+	}
+	if procSession(t, string(stat)) == procSession(t, string(own)) {
+		t.Errorf("detached command runs in the selector's session %s", procSession(t, string(own)))
+	}
+}
+
+func TestParseExtraArgs(t *testing.T) {
+	tests := []struct {
+		args     string
+		identity string
+		rest     []string
+		wantErr  bool
+	}{
+		{"", "", nil, false},
+		{"-i ~/.ssh/key.pem", "~/.ssh/key.pem", nil, false},
+		{"-i '/a b/key' --no-latency-control", "/a b/key", []string{"--no-latency-control"}, false},
+		{`-i "/a b/key"`, "/a b/key", nil, false},
+		{"-i=/keys/id_ed25519 -v", "/keys/id_ed25519", []string{"-v"}, false},
+		{"-i~/.ssh/key", "~/.ssh/key", nil, false},
+		{"-i/keys/key -x 10.0.0.1", "/keys/key", []string{"-x", "10.0.0.1"}, false},
+		{"-i /first -i /second", "/first", []string{"-i", "/second"}, false},
+		{"--no-latency-control -i", "", []string{"--no-latency-control"}, true},
+		{"-i '/a b/key", "", nil, true},
+		{"-ignore-me -v", "", []string{"-ignore-me", "-v"}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseExtraArgs(tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseExtraArgs(%q) error = %v, want error %v", tt.args, err, tt.wantErr)
+		}
+		if got.identityFile != tt.identity || !reflect.DeepEqual(got.rest, tt.rest) {
+			t.Errorf("parseExtraArgs(%q) = %q %q, want %q %q", tt.args, got.identityFile, got.rest, tt.identity, tt.rest)
+		}
+	}
+}
+
+func TestBuildSshuttleCommandSudo(t *testing.T) {
+	savedEuid, savedSudo := geteuid, sudoMode
+	defer func() { geteuid, sudoMode = savedEuid, savedSudo }()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	base := TunnelConfig{Name: "prod", Host: "prod.example.com", User: "ubuntu", Subnets: "10.0.0.0/8"}
+	withEnv := base
+	withEnv.Env = map[string]string{"AWS_PROFILE": "prod team"}
+	withKey := base
+	withKey.ExtraArgs = ExtraArgs{Line: "-i ~/.ssh/key.pem"}
+	plain, _ := buildSshuttleCommand(base)
+
+	tests := []struct {
+		name     string
+		tunnel   TunnelConfig
+		sudo     bool // -sudo
+		euid     int
+		agent    string // SSH_AUTH_SOCK
+		prefix   string
+		contains string
+	}{
+		{"no sudo", base, false, 1000, "", "sshuttle ", ""},
+		{"tunnel sudo", TunnelConfig{Name: "prod", Host: "prod.example.com", User: "ubuntu", Subnets: "10.0.0.0/8", Sudo: true}, false, 1000, "", "sudo sshuttle ", ""},
+		{"-sudo", base, true, 1000, "", "sudo sshuttle ", ""},
+		{"env", withEnv, true, 1000, "", "sudo env 'AWS_PROFILE=prod team' sshuttle ", ""},
+		{"agent", withEnv, true, 1000, "/tmp/agent.sock", "sudo env 'AWS_PROFILE=prod team' SSH_AUTH_SOCK=/tmp/agent.sock sshuttle ", ""},
+		{"key under sudo", withKey, true, 1000, "", "sudo sshuttle ", "-i " + shellQuote(filepath.Join(home, ".ssh/key.pem"))},
+		{"key without sudo", withKey, false, 1000, "", "sshuttle ", "-i " + shellQuote("~/.ssh/key.pem")},
+		{"root", base, true, 0, "/tmp/agent.sock", plain, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			geteuid = func() int { return tt.euid }
+			sudoMode = tt.sudo
+			t.Setenv("SSH_AUTH_SOCK", tt.agent)
+
+			command, _ := buildSshuttleCommand(tt.tunnel)
+			if !strings.HasPrefix(command, tt.prefix) {
+				t.Errorf("command = %s, want prefix %s", command, tt.prefix)
+			}
+			if !strings.Contains(command, tt.contains) {
+				t.Errorf("command = %s, want it to contain %s", command, tt.contains)
+			}
+		})
+	}
+}
+
+func TestDropFlags(t *testing.T) {
+	flags := map[string]bool{"--daemon": false, "--dns": false, "--ns-hosts": true}
+	tests := []struct {
+		args    string
+		kept    string
+		dropped []string
+	}{
+		{"--daemon --no-latency-control", "--no-latency-control", []string{"--daemon"}},
+		{"--ns-hosts 10.0.0.1 -v", "-v", []string{"--ns-hosts"}},
+		{"--ns-hosts=10.0.0.1 -v", "-v", []string{"--ns-hosts"}},
+		{"-v --latency-buffer-size 4096", "-v --latency-buffer-size 4096", nil},
+	}
+	for _, tt := range tests {
+		kept, dropped := dropFlags(tt.args, flags)
+		if kept != tt.kept || !reflect.DeepEqual(dropped, tt.dropped) {
+			t.Errorf("dropFlags(%q) = %q %q, want %q %q", tt.args, kept, dropped, tt.kept, tt.dropped)
+		}
+	}
+}
+
+func TestBuildSshuttleCommandDuplicateDaemon(t *testing.T) {
+	tunnel := TunnelConfig{
+		Name:      "prod",
+		Host:      "prod.example.com",
+		User:      "ubuntu",
+		Subnets:   "10.0.0.0/8",
+		ExtraArgs: ExtraArgs{Line: "--daemon --no-latency-control"},
+	}
+
+	command, warnings := buildSshuttleCommandWith(tunnel, true)
+	if n := strings.Count(command, "--daemon"); n != 1 {
+		t.Errorf("command %s has --daemon %d times, want once", command, n)
+	}
+	if !strings.Contains(command, "--no-latency-control") {
+		t.Errorf("command %s lost the other extra_args", command)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "ignoring --daemon") {
+		t.Errorf("warnings = %q, want one about --daemon", warnings)
+	}
+}
+
+func TestBuildSshuttleCommandSubnets(t *testing.T) {
+	for _, subnets := range []string{"10.0.0.0/8,172.16.0.0/12", "10.0.0.0/8 172.16.0.0/12", "10.0.0.0/8, 172.16.0.0/12"} {
+		tunnel := TunnelConfig{Name: "prod", Host: "prod.example.com", User: "ubuntu", Subnets: subnets}
+		command, _ := buildSshuttleCommandWith(tunnel, true)
+		if want := "-r ubuntu@prod.example.com 10.0.0.0/8 172.16.0.0/12 --daemon"; !strings.Contains(command, want) {
+			t.Errorf("subnets %q: command %s doesn't contain %s", subnets, command, want)
+		}
+	}
+}
+
+func TestBuildSshuttleCommandExcludeFrom(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	path := filepath.Join(home, "my excludes.txt")
+	if err := os.WriteFile(path, []byte("10.0.0.5/32\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tunnel := TunnelConfig{
+		Name:        "prod",
+		Host:        "prod.example.com",
+		User:        "ubuntu",
+		Subnets:     "10.0.0.0/8",
+		ExcludeFrom: "~/my excludes.txt",
+	}
+
+	command, warnings := buildSshuttleCommandWith(tunnel, false)
+	if want := " --exclude-from '" + path + "'"; !strings.Contains(command, want) {
+		t.Errorf("command %s doesn't contain %s", command, want)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("warnings = %q, want none", warnings)
+	}
+}
+
+func TestParseSshuttleArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    sshuttleArgs
+	}{
+		{
+			name:    "daemon",
+			command: "sshuttle -r ubuntu@prod.example.com 10.0.0.0/8 172.16.0.0/12 --daemon",
+			want:    sshuttleArgs{Remote: "ubuntu@prod.example.com", Subnets: []string{"10.0.0.0/8", "172.16.0.0/12"}, Daemon: true},
+		},
+		{
+			name:    "comma-joined subnets",
+			command: "sshuttle -r ubuntu@prod.example.com 10.0.0.0/8,172.16.0.0/12 10.9.0.1 --daemon",
+			want:    sshuttleArgs{Remote: "ubuntu@prod.example.com", Subnets: []string{"10.0.0.0/8", "172.16.0.0/12", "10.9.0.1/32"}, Daemon: true},
+		},
+		{
+			name:    "key in quoted ssh-cmd",
+			command: `sshuttle -r admin@bastion 10.1.0.0/16 -D --ssh-cmd="ssh -i '/keys/my key.pem' -o StrictHostKeyChecking=no"`,
+			want:    sshuttleArgs{Remote: "admin@bastion", Subnets: []string{"10.1.0.0/16"}, Daemon: true, SSHCmd: "ssh -i '/keys/my key.pem' -o StrictHostKeyChecking=no"},
+		},
+		{
+			name:    "key in ssh-cmd as shown by ps",
+			command: "/usr/bin/python3 /usr/bin/sshuttle -r u@h 10.0.0.0/8 --daemon --ssh-cmd=ssh -i /keys/id.pem -o StrictHostKeyChecking=no",
+			want:    sshuttleArgs{Remote: "u@h", Subnets: []string{"10.0.0.0/8"}, Daemon: true, SSHCmd: "ssh -i /keys/id.pem -o StrictHostKeyChecking=no"},
+		},
+		{
+			name:    "-e and glued remote",
+			command: "sshuttle -ru@h -e 'ssh -p 2222' 10.0.0.1 -vv",
+			want:    sshuttleArgs{Remote: "u@h", Subnets: []string{"10.0.0.1/32"}, SSHCmd: "ssh -p 2222", Verbose: 2},
+		},
+		{
+			name:    "excludes and other flags",
+			command: "sshuttle --remote=u@h 0/0 -x 10.0.0.5 --exclude=10.0.0.6 --exclude-from /etc/ex --dns --listen 0.0.0.0:0",
+			want: sshuttleArgs{
+				Remote:      "u@h",
+				Subnets:     []string{"0/0"},
+				Excludes:    []string{"10.0.0.5", "10.0.0.6"},
+				ExcludeFrom: "/etc/ex",
+				Flags:       []string{"--dns", "--listen", "0.0.0.0:0"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSshuttleArgs(tt.command)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSshuttleArgs() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	for _, command := range []string{"ssh -i key u@h", "sshuttle -r 'u@h"} {
+		if _, err := parseSshuttleArgs(command); err == nil {
+			t.Errorf("parseSshuttleArgs(%q) succeeded", command)
+		}
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	var b tailBuffer
+	for i := 0; i < 1000; i++ {
+		b.Write([]byte("client: Connected to server.\n"))
+	}
+	b.Write([]byte("fatal: You must be root (or enable su/sudo) to set the firewall\n"))
+
+	if len(b.String()) != stderrTail {
+		t.Errorf("tailBuffer kept %d bytes, want %d", len(b.String()), stderrTail)
+	}
+	if sshuttleErrorHint(b.String()) == "" {
+		t.Errorf("sshuttleErrorHint() found no hint in the tail %q", b.String()[stderrTail-100:])
+	}
+}
+
+func TestValidateUserHost(t *testing.T) {
+	tests := []struct {
+		user, host string
+		wantErr    bool
+	}{
+		{"ubuntu", "prod.example.com", false},
+		{"ubuntu", "10.0.0.1", false},
+		{"ubu ntu", "prod.example.com", true},
+		{"ubuntu\t", "prod.example.com", true},
+		{"ubuntu@prod", "prod.example.com", true},
+		{"ubuntu", "prod example.com", true},
+		{"ubuntu", "prod.example.com\n", true},
+	}
+	for _, tt := range tests {
+		if err := validateUserHost(tt.user, tt.host); (err != nil) != tt.wantErr {
+			t.Errorf("validateUserHost(%q, %q) = %v, want error %v", tt.user, tt.host, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTrimTunnels(t *testing.T) {
+	tunnels := trimTunnels([]TunnelConfig{
+		{Name: " prod ", User: " ubuntu\t", Host: "\tprod.example.com \n"},
+		{Name: "stage", User: "ad min", Host: "stage.example.com"},
+	})
+
+	if tunnels[0].User != "ubuntu" || tunnels[0].Host != "prod.example.com" {
+		t.Errorf("trimTunnels() = %q@%q, want ubuntu@prod.example.com", tunnels[0].User, tunnels[0].Host)
+	}
+	if tunnels[0].Name != " prod " {
+		t.Errorf("trimTunnels() changed the name to %q", tunnels[0].Name)
+	}
+	// Inner whitespace is left for validateUserHost to reject
+	if err := validateUserHost(tunnels[1].User, tunnels[1].Host); err == nil {
+		t.Errorf("validateUserHost(%q) after trimming succeeded", tunnels[1].User)
+	}
+}
+
+func TestValidateSubnets(t *testing.T) {
+	tests := []struct {
+		subnets string
+		wantErr bool
+	}{
+		{"10.0.0.0/8", false},
+		{"10.0.0.0/8,192.168.0.0/16", false},
+		// As passed by -subnets "10.0.0.0/8 192.168.0.0/16"
+		{"10.0.0.0/8 192.168.0.0/16", false},
+		{"10.0.0.0/8, 192.168.0.0/16", false},
+		{"  10.0.0.0/8\t192.168.0.0/16  ", false},
+		{"10.1. 10.0.0.5", false},
+		{"10.0.0.0/8 192.168.0.0/33", true},
+		{"10.0.0.0/8 prod", true},
+		{"", true},
+		{" , ", true},
+	}
+	for _, tt := range tests {
+		if err := validateSubnets(tt.subnets); (err != nil) != tt.wantErr {
+			t.Errorf("validateSubnets(%q) = %v, want error %v", tt.subnets, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNormalizeSubnets(t *testing.T) {
+	tests := []struct {
+		subnets, want string
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{"10.0.0.0/8 192.168.0.0/16", "10.0.0.0/8,192.168.0.0/16"},
+		{"10.0.0.0/8, 192.168.0.0/16", "10.0.0.0/8,192.168.0.0/16"},
+		{"  10.0.0.0/8\t 192.168.0.0/16 ", "10.0.0.0/8,192.168.0.0/16"},
+		{"10.1. 10.0.0.5", "10.1.0.0/16,10.0.0.5/32"},
+	}
+	for _, tt := range tests {
+		if got := normalizeSubnets(tt.subnets); got != tt.want {
+			t.Errorf("normalizeSubnets(%q) = %q, want %q", tt.subnets, got, tt.want)
+		}
+		if err := validateSubnets(normalizeSubnets(tt.subnets)); err != nil {
+			t.Errorf("validateSubnets(normalizeSubnets(%q)) = %v", tt.subnets, err)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := &Config{Tunnels: []TunnelConfig{
+		{Name: "prod", User: "ubuntu", Host: "prod.example.com", Subnets: "10.0.0.0/8"},
+		{Name: "stage", Users: []string{"ubuntu", "admin"}, Host: "stage.example.com", Alias: "st",
+			SubnetsFrom: filepath.Join(t.TempDir(), "missing.txt")},
+	}}
+	if err := validateConfig(config); err != nil {
+		t.Errorf("validateConfig() with only warnings = %v", err)
+	}
+	warnings := configWarnings(config)
+	// The subnets_from warning comes once per user
+	if len(warnings) != 3 || warnings[2] != "stage: alias is ignored with users" {
+		t.Errorf("configWarnings() = %q, want the missing subnets_from and the ignored alias", warnings)
+	}
+
+	config.Tunnels = append(config.Tunnels,
+		TunnelConfig{Name: "prod", User: "ubuntu", Host: "prod2.example.com", Subnets: "10.0.0.0/8"},
+		TunnelConfig{Name: "dev", Host: "dev.example.com", Subnets: "10.0.0.0/33"},
+	)
+	var problems configProblems
+	if !errors.As(validateConfig(config), &problems) {
+		t.Fatalf("validateConfig() = nil, want problems")
+	}
+	want := configProblems{
+		"prod: name is used by 2 tunnels",
+		"dev: user is required",
+	}
+	if len(problems) != 3 || problems[0] != want[0] || problems[1] != want[1] || !strings.HasPrefix(problems[2], "dev: invalid subnets") {
+		t.Errorf("validateConfig() = %q", problems)
+	}
+}
+
+// testModel returns a model listing items the way main sets it up.
+func testModel(t *testing.T, items []list.Item) model {
+	t.Helper()
+	l := list.New(items, itemDelegate{}, 80, 20)
+	l.SetFilteringEnabled(true)
+	m := model{list: l, latency: make(map[string]string)}
+	var err error
+	if m.keys, err = resolveKeybindings(nil); err != nil {
+		t.Fatal(err)
+	}
+	m.ensureSelectable()
+	return m
+}
+
+// press sends keys to m, feeding the list's filter results back to it the
+// way the program would.
+func press(m model, keys ...tea.KeyMsg) model {
+	for _, key := range keys {
+		next, cmd := m.Update(key)
+		m = next.(model)
+		for _, msg := range filterMessages(cmd) {
+			next, _ = m.Update(msg)
+			m = next.(model)
+		}
+	}
+	return m
+}
+
+// filterMessages runs cmd and returns the list.FilterMatchesMsg it
+// produces, directly or in a batch. Commands that wait, such as the
+// cursor blink, are given up on.
+func filterMessages(cmd tea.Cmd) []tea.Msg {
+	if cmd == nil {
+		return nil
+	}
+	result := make(chan tea.Msg, 1)
+	go func() { result <- cmd() }()
+	var msg tea.Msg
+	select {
+	case msg = <-result:
+	case <-time.After(50 * time.Millisecond):
+		return nil
+	}
+
+	switch msg := msg.(type) {
+	case tea.BatchMsg:
+		var msgs []tea.Msg
+		for _, c := range msg {
+			msgs = append(msgs, filterMessages(c)...)
+		}
+		return msgs
+	case list.FilterMatchesMsg:
+		return []tea.Msg{msg}
+	}
+	return nil
+}
+
+func runes(s string) tea.KeyMsg {
+	return tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(s)}
+}
+
+func TestSubmitEditFormWithoutUsers(t *testing.T) {
+	for _, users := range []string{",", ", ,", " , "} {
+		m := testModel(t, nil)
+		m.openAddForm()
+		m.editTunnel = TunnelConfig{Name: "prod", Users: []string{"ubuntu", "admin"}, Host: "prod.example.com"}
+		m.editName = "prod"
+		for field, value := range []string{"prod", "prod.example.com", users, "10.0.0.0/8", ""} {
+			m.addInputs[field].SetValue(value)
+		}
+
+		next, _ := m.submitAddForm()
+		m = next.(model)
+		if m.addErr != "User is required" || m.addFocus != addFieldUser {
+			t.Errorf("saving users %q: error %q on field %d, want User is required on the user field", users, m.addErr, m.addFocus)
+		}
+	}
+}
+
+func TestFilterWithoutMatches(t *testing.T) {
+	m := testModel(t, []list.Item{
+		item{name: "AVAILABLE TUNNELS", itemType: ItemAction},
+		item{name: "prod (prod.example.com)", itemType: ItemAvailableTunnel, destination: "ubuntu@prod.example.com"},
+		item{name: "stage (stage.example.com)", itemType: ItemAvailableTunnel, destination: "ubuntu@stage.example.com"},
+		item{name: "", itemType: ItemAction},
+		item{name: "+ Add New Tunnel", itemType: ItemAction, command: "add_new"},
+	})
+
+	// A header's text matches nothing, as headers can't be selected
+	for _, query := range []string{"AVAILABLE", "zzz"} {
+		t.Run(query, func(t *testing.T) {
+			m := press(m, runes("/"))
+			for _, r := range query {
+				m = press(m, runes(string(r)))
+			}
+			if n := len(m.list.VisibleItems()); n != 0 {
+				t.Fatalf("search %q shows %d items, want none", query, n)
+			}
+			if m.list.SelectedItem() != nil {
+				t.Errorf("search %q selected %+v", query, m.list.SelectedItem())
+			}
+			if view := m.View(); !strings.Contains(view, "Nothing matched") {
+				t.Errorf("view without matches doesn't say so:\n%s", view)
+			}
+
+			// Accepting an empty result clears the search and puts the
+			// cursor back on a tunnel, without starting anything
+			m = press(m, tea.KeyMsg{Type: tea.KeyEnter})
+			i, ok := m.list.SelectedItem().(item)
+			if !ok || !isSelectableItem(i) {
+				t.Errorf("after the search the cursor is on %+v", m.list.SelectedItem())
+			}
+			if m.choice != "" || m.quitting {
+				t.Errorf("search without matches set choice %q, quitting %v", m.choice, m.quitting)
+			}
+		})
+	}
+
+	// A search that matches lands on the tunnel, not the header
+	m = press(m, runes("/"), runes("s"), runes("t"), runes("a"), tea.KeyMsg{Type: tea.KeyEnter})
+	if i, ok := m.list.SelectedItem().(item); !ok || i.destination != "ubuntu@stage.example.com" {
+		t.Errorf("search selected %+v, want the stage tunnel", m.list.SelectedItem())
+	}
+}